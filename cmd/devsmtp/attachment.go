@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lawnchairsociety/devsmtp/internal/attachment"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/spf13/cobra"
+)
+
+var attachmentCmd = &cobra.Command{
+	Use:   "attachment",
+	Short: "List and extract attachments of captured messages",
+}
+
+var attachmentListCmd = &cobra.Command{
+	Use:   "list <msg-id>",
+	Short: "List the attachments of a message",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		attachments, err := loadAttachments(args[0])
+		if err != nil {
+			return err
+		}
+
+		if len(attachments) == 0 {
+			fmt.Println("No attachments")
+			return nil
+		}
+
+		for i, part := range attachments {
+			fmt.Printf("%d\t%s\t%s\t%s\n", i+1, attachment.Name(part), part.ContentType, attachment.FormatSize(part.Size))
+		}
+		return nil
+	},
+}
+
+var attachmentSaveCmd = &cobra.Command{
+	Use:   "save <msg-id> <index|name>",
+	Short: "Save an attachment to disk",
+	Long: `Save an attachment of a captured message to disk. The attachment is
+selected by its 1-based index (as shown by "attachment list") or by filename.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		attachments, err := loadAttachments(args[0])
+		if err != nil {
+			return err
+		}
+
+		part, err := attachment.Find(attachments, args[1])
+		if err != nil {
+			return err
+		}
+
+		dir, _ := cmd.Flags().GetString("out")
+		if dir == "" {
+			dir = cfg.Attachments.Dir
+		}
+
+		path, err := attachment.Save(dir, *part)
+		if err != nil {
+			return fmt.Errorf("failed to save attachment: %w", err)
+		}
+
+		fmt.Println(path)
+		return nil
+	},
+}
+
+func loadAttachments(idArg string) ([]database.Part, error) {
+	id, err := strconv.ParseInt(idArg, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message id %q", idArg)
+	}
+
+	db, err := database.New(cfg.Database.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+
+	if _, err := db.GetMessage(id); errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("message %d not found", id)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get message %d: %w", id, err)
+	}
+
+	return db.GetAttachments(id)
+}
+
+func init() {
+	attachmentSaveCmd.Flags().StringP("out", "o", "", "output directory (default is attachments.dir)")
+
+	attachmentCmd.AddCommand(attachmentListCmd)
+	attachmentCmd.AddCommand(attachmentSaveCmd)
+	rootCmd.AddCommand(attachmentCmd)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lawnchairsociety/devsmtp/internal/certs"
+	"github.com/lawnchairsociety/devsmtp/internal/smtp"
+	"github.com/spf13/cobra"
+)
+
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Manage the self-signed TLS certificate",
+}
+
+var certExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the CA certificate so clients can trust it",
+	Long: `Export the CA that signs the self-signed certificate used with tls.auto.
+Add it to the trust store of the client under test, or configure the client to
+skip certificate verification instead.
+
+The certificate is read from (or created in) tls.auto_dir, so the server must
+use the same directory. Without tls.auto_dir the server generates a new
+certificate in memory on every start and there is nothing stable to export.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, _ := cmd.Flags().GetString("dir")
+		if dir == "" {
+			dir = cfg.TLS.AutoDir
+		}
+		if dir == "" {
+			return errors.New("tls.auto_dir is not set; set it (or pass --dir) so the server and this command share a certificate")
+		}
+
+		bundle, err := certs.LoadOrCreate(dir, smtp.AutoTLSHosts(cfg))
+		if err != nil {
+			return fmt.Errorf("failed to load certificate: %w", err)
+		}
+
+		data := bundle.CACert
+		if server, _ := cmd.Flags().GetBool("server"); server {
+			data = bundle.Cert
+		}
+
+		out, _ := cmd.Flags().GetString("out")
+		if out == "" {
+			_, err := os.Stdout.Write(data)
+			return err
+		}
+		if err := os.WriteFile(out, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write certificate: %w", err)
+		}
+		fmt.Println(out)
+		return nil
+	},
+}
+
+func init() {
+	certExportCmd.Flags().String("dir", "", "certificate directory (default is tls.auto_dir)")
+	certExportCmd.Flags().StringP("out", "o", "", "write to this file instead of stdout")
+	certExportCmd.Flags().Bool("server", false, "export the server certificate instead of the CA")
+
+	certCmd.AddCommand(certExportCmd)
+	rootCmd.AddCommand(certCmd)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/spf13/cobra"
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Inspect and upgrade the database schema",
+}
+
+var dbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the schema version and pending migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := os.Stat(cfg.Database.Path); err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+
+		db, err := database.Open(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return fmt.Errorf("failed to read schema version: %w", err)
+		}
+		migrations, err := db.Migrations()
+		if err != nil {
+			return fmt.Errorf("failed to list migrations: %w", err)
+		}
+
+		latest := database.LatestSchemaVersion()
+		fmt.Printf("Database: %s\n", cfg.Database.Path)
+		fmt.Printf("Schema version: %d (latest: %d)\n", version, latest)
+		switch {
+		case version > latest:
+			fmt.Println("The database was written by a newer version of devsmtp; upgrade devsmtp to use it.")
+		case version < latest:
+			fmt.Println(`Pending migrations are applied at startup or with "devsmtp db migrate".`)
+		}
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tDESCRIPTION\tAPPLIED")
+		for _, m := range migrations {
+			applied := "pending"
+			if m.Applied() {
+				applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Description, applied)
+		}
+		return w.Flush()
+	},
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Apply pending schema migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := database.Open(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			fmt.Printf("Applied %d: %s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			fmt.Printf("Database is up to date (schema version %d)\n", database.LatestSchemaVersion())
+		}
+		return nil
+	},
+}
+
+func init() {
+	dbCmd.AddCommand(dbStatusCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	rootCmd.AddCommand(dbCmd)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/spf13/cobra"
+)
+
+var greylistCmd = &cobra.Command{
+	Use:   "greylist",
+	Short: "Inspect the greylisting state",
+}
+
+var greylistListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List greylisted (client IP, sender, recipient) triplets",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+
+		db, err := database.New(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		entries, err := db.ListGreylist(!all)
+		if err != nil {
+			return fmt.Errorf("failed to list greylist: %w", err)
+		}
+
+		if len(entries) == 0 {
+			fmt.Println("No greylisted triplets")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CLIENT IP\tSENDER\tRECIPIENT\tSTATUS\tATTEMPTS\tFIRST SEEN\tRETRY AFTER")
+		for _, entry := range entries {
+			status, retryAfter := "pending", entry.FirstSeen.Add(cfg.Greylist.Delay).Format("2006-01-02 15:04:05")
+			if entry.Passed() {
+				status, retryAfter = "passed", "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", entry.ClientIP, entry.Sender, entry.Recipient, status,
+				entry.Attempts, entry.FirstSeen.Format("2006-01-02 15:04:05"), retryAfter)
+		}
+		return w.Flush()
+	},
+}
+
+var greylistClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Forget all triplets, so every sender is greylisted again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, err := database.New(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		if err := db.ClearGreylist(); err != nil {
+			return fmt.Errorf("failed to clear greylist: %w", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	greylistListCmd.Flags().Bool("all", false, "include triplets that have passed")
+
+	greylistCmd.AddCommand(greylistListCmd, greylistClearCmd)
+	rootCmd.AddCommand(greylistCmd)
+}
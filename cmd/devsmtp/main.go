@@ -1,16 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/lawnchairsociety/devsmtp/internal/api"
 	"github.com/lawnchairsociety/devsmtp/internal/config"
 	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/retention"
 	"github.com/lawnchairsociety/devsmtp/internal/smtp"
 	"github.com/lawnchairsociety/devsmtp/internal/tui"
 	"github.com/spf13/cobra"
 )
 
+const shutdownTimeout = 10 * time.Second
+
 var (
 	cfgFile string
 	cfg     *config.Config
@@ -29,7 +38,19 @@ var rootCmd = &cobra.Command{
 	Long: `DevSmtp is a lightweight SMTP server that captures all emails
 sent to it and stores them in a SQLite database. It provides a
 terminal-based UI for viewing and managing messages.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		cfg, err = config.Load(cfgFile, cmd)
+		if err != nil {
+			return fmt.Errorf("error loading config: %w", err)
+		}
+		return nil
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfg.Log.Format != smtp.LogFormatPlain && cfg.Log.Format != smtp.LogFormatJSON {
+			return fmt.Errorf("invalid log format %q: must be %q or %q", cfg.Log.Format, smtp.LogFormatPlain, smtp.LogFormatJSON)
+		}
+
 		db, err := database.New(cfg.Database.Path)
 		if err != nil {
 			return fmt.Errorf("failed to open database: %w", err)
@@ -40,37 +61,122 @@ terminal-based UI for viewing and managing messages.`,
 		logger := smtp.NewLogger(1000)
 
 		// Start SMTP server in background
-		server := smtp.NewServer(cfg, db, logger)
+		server, err := smtp.NewServer(cfg, db, logger)
+		if err != nil {
+			return err
+		}
+		serverErr := make(chan error, 1)
 		go func() {
-			if err := server.ListenAndServe(); err != nil {
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
 				logger.Error("SMTP server error: %v", err)
+				serverErr <- err
 			}
 		}()
 
+		// Start HTTP API in background
+		var apiServer *api.Server
+		if cfg.API.Enabled {
+			apiServer = api.NewServer(cfg, db, logger)
+			go func() {
+				if err := apiServer.ListenAndServe(); err != nil {
+					logger.Error("HTTP API error: %v", err)
+				}
+			}()
+		}
+
+		// Prune old messages in background
+		janitorCtx, stopJanitor := context.WithCancel(context.Background())
+		janitorDone := make(chan struct{})
+		go func() {
+			defer close(janitorDone)
+			retention.New(cfg.Retention, db, logger).Run(janitorCtx)
+		}()
+
+		// Let in-flight deliveries finish before closing the database
+		shutdown := func() {
+			stopJanitor()
+			<-janitorDone
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("SMTP server shutdown: %v", err)
+			}
+			if apiServer != nil {
+				_ = apiServer.Shutdown(ctx)
+			}
+		}
+
+		if cfg.Headless {
+			return runHeadless(logger, serverErr, shutdown)
+		}
+
 		// Run TUI in foreground with log channel
-		return tui.Run(db, cfg, logger.Channel())
+		err = tui.Run(db, cfg, logger.Channel())
+		shutdown()
+		return err
 	},
 }
 
+// runHeadless streams log entries to stdout/stderr until the process receives
+// SIGINT or SIGTERM, or the SMTP server fails, and keeps streaming while the
+// servers shut down.
+func runHeadless(logger *smtp.Logger, serverErr <-chan error, shutdown func()) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	drainCtx, stopDrain := context.WithCancel(context.Background())
+	drained := make(chan error, 1)
+	go func() {
+		drained <- logger.Drain(drainCtx, os.Stdout, os.Stderr, cfg.Log.Format)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		logger.Info("Received shutdown signal, stopping")
+	case err = <-serverErr:
+	}
+
+	shutdown()
+
+	stopDrain()
+	if drainErr := <-drained; drainErr != nil && err == nil {
+		err = drainErr
+	}
+
+	return err
+}
+
 func init() {
-	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./devsmtp.yaml)")
+	rootCmd.PersistentFlags().String("db", "./devsmtp.db", "SQLite database path")
+	rootCmd.PersistentFlags().String("relay-host", "", "Upstream SMTP server that released messages are sent to")
+	rootCmd.PersistentFlags().Int("relay-port", 587, "Upstream SMTP server port")
 
-	rootCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is ./devsmtp.yaml)")
 	rootCmd.Flags().String("host", "0.0.0.0", "SMTP server bind address")
 	rootCmd.Flags().Int("port", 587, "SMTP server port")
-	rootCmd.Flags().String("db", "./devsmtp.db", "SQLite database path")
+	rootCmd.Flags().Int("max-message-size", 10485760, "Maximum message size in bytes")
+	rootCmd.Flags().Int("max-messages", 0, "Keep at most this many messages, pruning the oldest (0 for no limit)")
+	rootCmd.Flags().Duration("max-age", 0, "Prune messages older than this, e.g. 168h (0 for no limit)")
+	rootCmd.Flags().Int("max-sessions", 0, "Maximum concurrent SMTP sessions (0 for unlimited)")
+	rootCmd.Flags().Int("tls-port", 0, "Implicit TLS (SMTPS) port, e.g. 465 (0 disables)")
 	rootCmd.Flags().Bool("auth-required", false, "Require SMTP authentication")
 	rootCmd.Flags().String("auth-user", "", "Username for SMTP AUTH")
 	rootCmd.Flags().String("auth-pass", "", "Password for SMTP AUTH")
 	rootCmd.Flags().String("tls-cert", "", "Path to TLS certificate")
 	rootCmd.Flags().String("tls-key", "", "Path to TLS private key")
-}
-
-func initConfig() {
-	var err error
-	cfg, err = config.Load(cfgFile, rootCmd)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-		os.Exit(1)
-	}
+	rootCmd.Flags().Bool("tls-auto", false, "Generate a self-signed TLS certificate if no cert/key is given")
+	rootCmd.Flags().String("tls-auto-dir", "", "Directory to cache the self-signed certificate in (default in memory)")
+	rootCmd.Flags().Bool("api", true, "Enable the HTTP API")
+	rootCmd.Flags().String("api-host", "127.0.0.1", "HTTP API bind address (use 0.0.0.0 to allow remote clients)")
+	rootCmd.Flags().Int("api-port", 8025, "HTTP API port")
+	rootCmd.Flags().Bool("headless", false, "Run without the TUI and write logs to stdout/stderr")
+	rootCmd.Flags().String("log-format", "plain", "Log format in headless mode (plain or json)")
+	rootCmd.Flags().String("attachment-dir", "./attachments", "Directory the TUI saves attachments to")
+	rootCmd.Flags().Bool("proxy-protocol", false, "Expect a PROXY protocol header from trusted proxies")
+	rootCmd.Flags().StringSlice("proxy-trusted", nil, "Addresses or CIDRs of proxies allowed to send a PROXY header")
+	rootCmd.Flags().StringSlice("xclient-trusted", nil, "Addresses or CIDRs of peers allowed to use XCLIENT and XFORWARD")
+	rootCmd.Flags().StringSlice("relay-auto", nil, "Recipient patterns (e.g. *@example.com) relayed upstream as soon as a message is captured")
+	rootCmd.Flags().Bool("greylist", false, "Reject the first delivery attempt per client, sender and recipient with 451")
+	rootCmd.Flags().Duration("greylist-delay", 5*time.Minute, "How long a greylisted client must wait before retrying")
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/spf13/cobra"
+)
+
+var messagesCmd = &cobra.Command{
+	Use:   "messages",
+	Short: "Query captured messages",
+}
+
+var messagesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List captured messages, newest first",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, _ := cmd.Flags().GetString("user")
+		to, _ := cmd.Flags().GetString("to")
+		search, _ := cmd.Flags().GetString("search")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		db, err := database.New(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		messages, total, err := db.ListMessages(database.ListOptions{
+			Search:    search,
+			User:      user,
+			Recipient: to,
+			Limit:     limit,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list messages: %w", err)
+		}
+
+		if len(messages) == 0 {
+			fmt.Println("No messages")
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDATE\tUSER\tFROM\tSUBJECT")
+		for _, msg := range messages {
+			from := msg.From
+			if from == "" {
+				from = msg.Sender
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", msg.ID, msg.CreatedAt.Format("2006-01-02 15:04:05"), msg.AuthUser, from, msg.Subject)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if total > len(messages) {
+			fmt.Printf("(%d of %d messages)\n", len(messages), total)
+		}
+		return nil
+	},
+}
+
+func init() {
+	messagesListCmd.Flags().String("user", "", "only show messages sent by this SMTP AUTH user")
+	messagesListCmd.Flags().String("to", "", "only show messages with this envelope, To, Cc or Bcc recipient")
+	messagesListCmd.Flags().StringP("search", "q", "", "search sender, recipients, subject and body")
+	messagesListCmd.Flags().IntP("limit", "n", 50, "maximum number of messages to show (0 for all)")
+
+	messagesCmd.AddCommand(messagesListCmd)
+	rootCmd.AddCommand(messagesCmd)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/relay"
+	"github.com/spf13/cobra"
+)
+
+var releaseCmd = &cobra.Command{
+	Use:   "release <msg-id>",
+	Short: "Send a captured message on to the upstream SMTP server",
+	Long: `Send a captured message, exactly as it was received, to the upstream
+SMTP server configured under "relay". It is delivered to the --to addresses,
+or to relay.release_to if none are given; the original recipients are never
+used.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		to, _ := cmd.Flags().GetStringSlice("to")
+
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message id %q", args[0])
+		}
+
+		rl, err := relay.New(cfg.Relay)
+		if err != nil {
+			return err
+		}
+
+		db, err := database.New(cfg.Database.Path)
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		defer db.Close()
+
+		msg, err := db.GetMessage(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("message %d not found", id)
+		} else if err != nil {
+			return fmt.Errorf("failed to get message %d: %w", id, err)
+		}
+
+		to, err = rl.Release(msg, to)
+		if err != nil {
+			return fmt.Errorf("failed to release message %d: %w", id, err)
+		}
+
+		fmt.Printf("Message %d released to %s via %s\n", id, strings.Join(to, ", "), rl.Addr())
+		return nil
+	},
+}
+
+func init() {
+	releaseCmd.Flags().StringSlice("to", nil, "recipient address (repeatable; default is relay.release_to)")
+
+	rootCmd.AddCommand(releaseCmd)
+}
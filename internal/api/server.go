@@ -0,0 +1,557 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/attachment"
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/relay"
+	"github.com/lawnchairsociety/devsmtp/internal/smtp"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+type Server struct {
+	config     *config.Config
+	db         *database.DB
+	logger     *smtp.Logger
+	httpServer *http.Server
+}
+
+func NewServer(cfg *config.Config, db *database.DB, logger *smtp.Logger) *Server {
+	s := &Server{
+		config: cfg,
+		db:     db,
+		logger: logger,
+	}
+
+	s.httpServer = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /api/messages", s.handleListMessages)
+	mux.HandleFunc("DELETE /api/messages", s.handleDeleteAllMessages)
+	mux.HandleFunc("GET /api/messages/search", s.handleSearchMessages)
+	mux.HandleFunc("GET /api/messages/{id}", s.handleGetMessage)
+	mux.HandleFunc("DELETE /api/messages/{id}", s.handleDeleteMessage)
+	mux.HandleFunc("GET /api/messages/{id}/raw", s.handleGetRawMessage)
+	mux.HandleFunc("POST /api/messages/{id}/read", s.handleMarkAsRead)
+	mux.HandleFunc("POST /api/messages/{id}/release", s.handleReleaseMessage)
+	mux.HandleFunc("GET /api/messages/{id}/attachments/{ref}", s.handleGetAttachment)
+	mux.HandleFunc("GET /api/greylist", s.handleListGreylist)
+	mux.HandleFunc("DELETE /api/greylist", s.handleClearGreylist)
+
+	return mux
+}
+
+func (s *Server) ListenAndServe() error {
+	addr := net.JoinHostPort(s.config.API.Host, strconv.Itoa(s.config.API.Port))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s.logger.Info("HTTP API listening on %s", addr)
+
+	err = s.httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+type messageResponse struct {
+	ID         int64      `json:"id"`
+	Sender     string     `json:"sender"`
+	Recipients []string   `json:"recipients"`
+	Subject    string     `json:"subject"`
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Cc         string     `json:"cc,omitempty"`
+	ReplyTo    string     `json:"reply_to,omitempty"`
+	RawHeaders rawHeaders `json:"raw_headers"`
+	Body       string     `json:"body"`
+	HTMLBody   string     `json:"html_body"`
+	Size       int        `json:"size"`
+	ClientIP   string     `json:"client_ip"`
+	ClientName string     `json:"client_name,omitempty"`
+	AuthUser   string     `json:"auth_user,omitempty"`
+	SMTPUTF8   bool       `json:"smtputf8"`
+	IsRead     bool       `json:"is_read"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	Attachments      []attachmentResponse `json:"attachments,omitempty"`
+	Envelope         *envelopeResponse    `json:"envelope,omitempty"`
+	HeaderRecipients []recipientResponse  `json:"header_recipients,omitempty"`
+}
+
+type rawHeaders struct {
+	Subject string `json:"subject"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Cc      string `json:"cc,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+}
+
+// envelopeResponse describes the SMTP transaction, as opposed to the message
+// headers.
+type envelopeResponse struct {
+	Helo          string              `json:"helo"`
+	MailParams    string              `json:"mail_params,omitempty"`
+	TLS           bool                `json:"tls"`
+	Authenticated bool                `json:"authenticated"`
+	Ret           string              `json:"ret,omitempty"`
+	EnvID         string              `json:"envid,omitempty"`
+	Recipients    []recipientResponse `json:"recipients"`
+}
+
+type recipientResponse struct {
+	Type    string `json:"type,omitempty"` // to, cc or bcc for header recipients
+	Address string `json:"address"`
+	Notify  string `json:"notify,omitempty"`
+	ORCPT   string `json:"orcpt,omitempty"`
+}
+
+type attachmentResponse struct {
+	Index       int    `json:"index"`
+	Path        string `json:"path"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	Size        int    `json:"size"`
+}
+
+type messageListResponse struct {
+	Total    int               `json:"total"`
+	Limit    int               `json:"limit"`
+	Offset   int               `json:"offset"`
+	Messages []messageResponse `json:"messages"`
+}
+
+type greylistResponse struct {
+	Entries []greylistEntryResponse `json:"entries"`
+}
+
+type greylistEntryResponse struct {
+	ClientIP  string     `json:"client_ip"`
+	Sender    string     `json:"sender"`
+	Recipient string     `json:"recipient"`
+	Status    string     `json:"status"` // pending or passed
+	Attempts  int        `json:"attempts"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	PassedAt  *time.Time `json:"passed_at,omitempty"`
+}
+
+// releaseRequest is the optional body of a release. Recipients must be
+// listed in relay.release_to; without any the message goes to all of them.
+type releaseRequest struct {
+	To []string `json:"to"`
+}
+
+type releaseResponse struct {
+	ID    int64    `json:"id"`
+	To    []string `json:"to"`
+	Relay string   `json:"relay"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func newMessageResponse(msg *database.Message) messageResponse {
+	recipients := make([]string, 0)
+	for _, rcpt := range strings.Split(msg.Recipients, ",") {
+		if rcpt = strings.TrimSpace(rcpt); rcpt != "" {
+			recipients = append(recipients, rcpt)
+		}
+	}
+
+	return messageResponse{
+		ID:         msg.ID,
+		Sender:     msg.Sender,
+		Recipients: recipients,
+		Subject:    msg.Subject,
+		From:       msg.From,
+		To:         msg.To,
+		Cc:         msg.Cc,
+		ReplyTo:    msg.ReplyTo,
+		RawHeaders: rawHeaders{
+			Subject: msg.RawSubject,
+			From:    msg.RawFrom,
+			To:      msg.RawTo,
+			Cc:      msg.RawCc,
+			ReplyTo: msg.RawReplyTo,
+		},
+		Body:       msg.Body,
+		HTMLBody:   msg.HTMLBody,
+		Size:       msg.Size,
+		ClientIP:   msg.ClientIP,
+		ClientName: msg.ClientName,
+		AuthUser:   msg.AuthUser,
+		SMTPUTF8:   msg.SMTPUTF8,
+		IsRead:     msg.IsRead,
+		CreatedAt:  msg.CreatedAt,
+	}
+}
+
+func (s *Server) handleListMessages(w http.ResponseWriter, r *http.Request) {
+	s.listMessages(w, r, database.ListOptions{
+		Search:    r.URL.Query().Get("q"),
+		User:      r.URL.Query().Get("user"),
+		Recipient: r.URL.Query().Get("to"),
+	})
+}
+
+func (s *Server) handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	term := r.URL.Query().Get("q")
+	if term == "" {
+		s.writeError(w, http.StatusBadRequest, "missing search term: use ?q=")
+		return
+	}
+
+	s.listMessages(w, r, database.ListOptions{
+		Search:    term,
+		User:      r.URL.Query().Get("user"),
+		Recipient: r.URL.Query().Get("to"),
+	})
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, r *http.Request, opts database.ListOptions) {
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil || limit < 1 {
+		s.writeError(w, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil || offset < 0 {
+		s.writeError(w, http.StatusBadRequest, "invalid offset")
+		return
+	}
+
+	opts.Limit = limit
+	opts.Offset = offset
+
+	messages, total, err := s.db.ListMessages(opts)
+	if err != nil {
+		s.logger.Error("API: failed to list messages: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to list messages")
+		return
+	}
+
+	resp := messageListResponse{
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+		Messages: make([]messageResponse, 0, len(messages)),
+	}
+	for i := range messages {
+		resp.Messages = append(resp.Messages, newMessageResponse(&messages[i]))
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.db.GetAttachments(msg.ID)
+	if err != nil {
+		s.logger.Error("API: failed to get attachments for message %d: %v", msg.ID, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get attachments")
+		return
+	}
+
+	resp := newMessageResponse(msg)
+	resp.Attachments = make([]attachmentResponse, 0, len(attachments))
+	for i, part := range attachments {
+		resp.Attachments = append(resp.Attachments, attachmentResponse{
+			Index:       i + 1,
+			Path:        part.Path,
+			Filename:    part.Filename,
+			ContentType: part.ContentType,
+			ContentID:   part.ContentID,
+			Disposition: part.Disposition,
+			Size:        part.Size,
+		})
+	}
+
+	recipients, err := s.db.GetRecipients(msg.ID)
+	if err != nil {
+		s.logger.Error("API: failed to get recipients for message %d: %v", msg.ID, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get recipients")
+		return
+	}
+
+	resp.Envelope = &envelopeResponse{
+		Helo:          msg.Helo,
+		MailParams:    msg.MailParams,
+		TLS:           msg.TLS,
+		Authenticated: msg.Authenticated,
+		Ret:           msg.DSNRet,
+		EnvID:         msg.DSNEnvID,
+		Recipients:    make([]recipientResponse, 0, len(recipients)),
+	}
+	for _, rcpt := range recipients {
+		if rcpt.Type != database.RecipientRcpt {
+			resp.HeaderRecipients = append(resp.HeaderRecipients, recipientResponse{
+				Type:    rcpt.Type,
+				Address: rcpt.Address,
+			})
+			continue
+		}
+		resp.Envelope.Recipients = append(resp.Envelope.Recipients, recipientResponse{
+			Address: rcpt.Address,
+			Notify:  rcpt.Notify,
+			ORCPT:   rcpt.ORCPT,
+		})
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetRawMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Length", strconv.Itoa(len(msg.RawData)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(msg.RawData)
+}
+
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	attachments, err := s.db.GetAttachments(msg.ID)
+	if err != nil {
+		s.logger.Error("API: failed to get attachments for message %d: %v", msg.ID, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get attachments")
+		return
+	}
+
+	part, err := attachment.Find(attachments, r.PathValue("ref"))
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	contentType := part.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name(*part)}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Data)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(part.Data)
+}
+
+func (s *Server) handleMarkAsRead(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.MarkAsRead(msg.ID); err != nil {
+		s.logger.Error("API: failed to mark message %d as read: %v", msg.ID, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to mark message as read")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleReleaseMessage(w http.ResponseWriter, r *http.Request) {
+	var req releaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		s.writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	rl, err := relay.New(s.config.Relay)
+	if errors.Is(err, relay.ErrNotConfigured) {
+		s.writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := rl.CheckAllowed(req.To); err != nil {
+		s.writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	to, err := rl.Release(msg, req.To)
+	if errors.Is(err, relay.ErrNoRecipients) {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("API: failed to release message %d: %v", msg.ID, err)
+		s.writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	s.logger.Info("API: message %d released to %s via %s", msg.ID, strings.Join(to, ", "), rl.Addr())
+	s.writeJSON(w, http.StatusOK, releaseResponse{ID: msg.ID, To: to, Relay: rl.Addr()})
+}
+
+func (s *Server) handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
+	msg, ok := s.lookupMessage(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteMessage(msg.ID); err != nil {
+		s.logger.Error("API: failed to delete message %d: %v", msg.ID, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to delete message")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDeleteAllMessages(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if user := r.URL.Query().Get("user"); user != "" {
+		err = s.db.DeleteUserMessages(user)
+	} else {
+		err = s.db.DeleteAllMessages()
+	}
+	if err != nil {
+		s.logger.Error("API: failed to delete all messages: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to delete messages")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListGreylist(w http.ResponseWriter, r *http.Request) {
+	pendingOnly := r.URL.Query().Get("pending") == "true"
+
+	entries, err := s.db.ListGreylist(pendingOnly)
+	if err != nil {
+		s.logger.Error("API: failed to list greylist: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to list greylist")
+		return
+	}
+
+	resp := greylistResponse{Entries: make([]greylistEntryResponse, 0, len(entries))}
+	for _, entry := range entries {
+		item := greylistEntryResponse{
+			ClientIP:  entry.ClientIP,
+			Sender:    entry.Sender,
+			Recipient: entry.Recipient,
+			Status:    "pending",
+			Attempts:  entry.Attempts,
+			FirstSeen: entry.FirstSeen,
+			LastSeen:  entry.LastSeen,
+		}
+		if entry.Passed() {
+			item.Status = "passed"
+			item.PassedAt = &entry.PassedAt
+		}
+		resp.Entries = append(resp.Entries, item)
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleClearGreylist(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.ClearGreylist(); err != nil {
+		s.logger.Error("API: failed to clear greylist: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "failed to clear greylist")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) lookupMessage(w http.ResponseWriter, r *http.Request) (*database.Message, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid message id")
+		return nil, false
+	}
+
+	msg, err := s.db.GetMessage(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.writeError(w, http.StatusNotFound, "message not found")
+		return nil, false
+	}
+	if err != nil {
+		s.logger.Error("API: failed to get message %d: %v", id, err)
+		s.writeError(w, http.StatusInternalServerError, "failed to get message")
+		return nil, false
+	}
+
+	return msg, true
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error("API: failed to encode response: %v", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, errorResponse{Error: message})
+}
+
+func queryInt(r *http.Request, key string, def int) (int, error) {
+	val := r.URL.Query().Get(key)
+	if val == "" {
+		return def, nil
+	}
+	return strconv.Atoi(val)
+}
@@ -0,0 +1,635 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/smtp"
+)
+
+func setupTestAPI(t *testing.T) (*httptest.Server, *database.DB, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "devsmtp-test-*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpFile.Close()
+
+	db, err := database.New(tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		t.Fatalf("failed to create database: %v", err)
+	}
+
+	server := NewServer(&config.Config{}, db, smtp.NewLogger(100))
+	ts := httptest.NewServer(server.Handler())
+
+	cleanup := func() {
+		ts.Close()
+		db.Close()
+		os.Remove(tmpFile.Name())
+	}
+
+	return ts, db, cleanup
+}
+
+func saveTestMessage(t *testing.T, db *database.DB, subject string) *database.Message {
+	t.Helper()
+
+	msg := &database.Message{
+		Sender:     "sender@example.com",
+		Recipients: "alice@example.com, bob@example.com",
+		Subject:    subject,
+		Body:       "Body of " + subject,
+		RawData:    []byte("Subject: " + subject + "\r\n\r\nBody of " + subject),
+		Size:       10,
+		ClientIP:   "127.0.0.1",
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+	return msg
+}
+
+func doRequest(t *testing.T, method, url string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+func decodeJSON(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		saveTestMessage(t, db, fmt.Sprintf("Message %d", i))
+	}
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages?limit=2&offset=0")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var list messageListResponse
+	decodeJSON(t, resp, &list)
+
+	if list.Total != 3 {
+		t.Errorf("expected total 3, got %d", list.Total)
+	}
+	if len(list.Messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(list.Messages))
+	}
+	if list.Messages[0].Subject != "Message 2" {
+		t.Errorf("expected newest message first, got %q", list.Messages[0].Subject)
+	}
+	if len(list.Messages[0].Recipients) != 2 {
+		t.Errorf("expected 2 recipients, got %v", list.Messages[0].Recipients)
+	}
+}
+
+func TestListMessagesByUser(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for _, user := range []string{"team-a", "team-b", "team-a"} {
+		msg := &database.Message{
+			Sender:     user + "@example.com",
+			Recipients: "alice@example.com",
+			Subject:    "From " + user,
+			AuthUser:   user,
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages?user=team-a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var list messageListResponse
+	decodeJSON(t, resp, &list)
+	if list.Total != 2 {
+		t.Errorf("expected 2 messages for team-a, got %d", list.Total)
+	}
+	for _, msg := range list.Messages {
+		if msg.AuthUser != "team-a" {
+			t.Errorf("expected auth_user team-a, got %q", msg.AuthUser)
+		}
+	}
+
+	resp = doRequest(t, http.MethodDelete, ts.URL+"/api/messages?user=team-a")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].AuthUser != "team-b" {
+		t.Errorf("expected only team-b's message to remain, got %+v", messages)
+	}
+}
+
+func TestListMessagesByRecipient(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for _, rcpt := range []string{"bob@example.com", "carol@example.com"} {
+		msg := &database.Message{
+			Sender:             "sender@example.com",
+			Recipients:         rcpt,
+			Subject:            "To " + rcpt,
+			EnvelopeRecipients: []database.Recipient{{Address: rcpt}},
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages?to=Bob@Example.com")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var list messageListResponse
+	decodeJSON(t, resp, &list)
+	if list.Total != 1 || len(list.Messages) != 1 || list.Messages[0].Subject != "To bob@example.com" {
+		t.Errorf("expected only the message to bob, got %+v", list.Messages)
+	}
+}
+
+func TestListMessagesInvalidLimit(t *testing.T) {
+	ts, _, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages?limit=abc")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := saveTestMessage(t, db, "Hello")
+
+	resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var got messageResponse
+	decodeJSON(t, resp, &got)
+
+	if got.ID != msg.ID {
+		t.Errorf("expected id %d, got %d", msg.ID, got.ID)
+	}
+	if got.Subject != "Hello" {
+		t.Errorf("expected subject 'Hello', got %q", got.Subject)
+	}
+	if got.Body != "Body of Hello" {
+		t.Errorf("expected body 'Body of Hello', got %q", got.Body)
+	}
+}
+
+func TestGetMessageDecodedHeaders(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := &database.Message{
+		Sender:     "sender@example.com",
+		Recipients: "alice@example.com",
+		Subject:    "Grüße",
+		RawSubject: "=?UTF-8?Q?Gr=C3=BC=C3=9Fe?=",
+		From:       "Renée <sender@example.com>",
+		RawFrom:    "=?UTF-8?Q?Ren=C3=A9e?= <sender@example.com>",
+		To:         "alice@example.com",
+		RawTo:      "alice@example.com",
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var got messageResponse
+	decodeJSON(t, resp, &got)
+
+	if got.Subject != "Grüße" || got.From != "Renée <sender@example.com>" {
+		t.Errorf("expected decoded headers, got subject %q from %q", got.Subject, got.From)
+	}
+	if got.RawHeaders.Subject != msg.RawSubject || got.RawHeaders.From != msg.RawFrom {
+		t.Errorf("expected raw headers, got %+v", got.RawHeaders)
+	}
+}
+
+func TestGetMessageEnvelope(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := &database.Message{
+		Sender:     "sender@example.com",
+		Recipients: "alice@example.com",
+		Helo:       "client.example.com",
+		MailParams: "RET=FULL ENVID=env-1",
+		TLS:        true,
+		DSNRet:     "FULL",
+		DSNEnvID:   "env-1",
+		EnvelopeRecipients: []database.Recipient{
+			{Address: "alice@example.com", Notify: "NEVER", ORCPT: "rfc822;alice@example.com"},
+		},
+		HeaderRecipients: []database.Recipient{
+			{Type: database.RecipientTo, Address: "list@example.com"},
+		},
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var got messageResponse
+	decodeJSON(t, resp, &got)
+
+	if got.Envelope == nil {
+		t.Fatal("expected envelope in response")
+	}
+	if got.Envelope.Ret != "FULL" || got.Envelope.EnvID != "env-1" || got.Envelope.Helo != "client.example.com" ||
+		got.Envelope.MailParams != "RET=FULL ENVID=env-1" || !got.Envelope.TLS || got.Envelope.Authenticated {
+		t.Errorf("unexpected envelope: %+v", got.Envelope)
+	}
+	want := recipientResponse{Address: "alice@example.com", Notify: "NEVER", ORCPT: "rfc822;alice@example.com"}
+	if len(got.Envelope.Recipients) != 1 || got.Envelope.Recipients[0] != want {
+		t.Errorf("unexpected envelope recipients: %+v", got.Envelope.Recipients)
+	}
+	if len(got.HeaderRecipients) != 1 || got.HeaderRecipients[0] != (recipientResponse{Type: "to", Address: "list@example.com"}) {
+		t.Errorf("unexpected header recipients: %+v", got.HeaderRecipients)
+	}
+}
+
+func TestGetMessageAttachments(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := &database.Message{
+		Sender:     "sender@example.com",
+		Recipients: "alice@example.com",
+		Subject:    "Invoice",
+		Body:       "See attached.",
+		HTMLBody:   "<p>See attached.</p>",
+		Parts: []database.Part{
+			{Path: "1", ContentType: "text/plain", Data: []byte("See attached.")},
+			{Path: "2", ContentType: "application/pdf", Filename: "invoice.pdf", Disposition: "attachment", IsAttachment: true, Data: []byte("%PDF-1.4")},
+		},
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var got messageResponse
+	decodeJSON(t, resp, &got)
+
+	if got.HTMLBody != "<p>See attached.</p>" {
+		t.Errorf("unexpected html body: %q", got.HTMLBody)
+	}
+	if len(got.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(got.Attachments))
+	}
+	att := got.Attachments[0]
+	if att.Index != 1 || att.Filename != "invoice.pdf" || att.ContentType != "application/pdf" || att.Size != 8 {
+		t.Errorf("unexpected attachment: %+v", att)
+	}
+
+	for _, ref := range []string{"1", "invoice.pdf"} {
+		resp = doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d/attachments/%s", ts.URL, msg.ID, ref))
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200 for attachment %s, got %d", ref, resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/pdf" {
+			t.Errorf("expected application/pdf, got %q", ct)
+		}
+		if string(body) != "%PDF-1.4" {
+			t.Errorf("unexpected attachment body: %q", body)
+		}
+	}
+
+	resp = doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d/attachments/2", ts.URL, msg.ID))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for missing attachment, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetMessageNotFound(t *testing.T) {
+	ts, _, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages/999")
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+
+	var apiErr errorResponse
+	decodeJSON(t, resp, &apiErr)
+	if apiErr.Error == "" {
+		t.Error("expected error message in response")
+	}
+}
+
+func TestGetRawMessage(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := saveTestMessage(t, db, "Raw")
+
+	resp := doRequest(t, http.MethodGet, fmt.Sprintf("%s/api/messages/%d/raw", ts.URL, msg.ID))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "message/rfc822" {
+		t.Errorf("expected message/rfc822 content type, got %q", ct)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if string(body) != string(msg.RawData) {
+		t.Errorf("expected raw data %q, got %q", msg.RawData, body)
+	}
+}
+
+func TestMarkAsRead(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := saveTestMessage(t, db, "Unread")
+
+	resp := doRequest(t, http.MethodPost, fmt.Sprintf("%s/api/messages/%d/read", ts.URL, msg.ID))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	retrieved, err := db.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if !retrieved.IsRead {
+		t.Error("expected message to be marked as read")
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	msg := saveTestMessage(t, db, "Doomed")
+
+	resp := doRequest(t, http.MethodDelete, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	if _, err := db.GetMessage(msg.ID); err == nil {
+		t.Error("expected error when getting deleted message")
+	}
+
+	resp = doRequest(t, http.MethodDelete, fmt.Sprintf("%s/api/messages/%d", ts.URL, msg.ID))
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for already deleted message, got %d", resp.StatusCode)
+	}
+}
+
+func TestDeleteAllMessages(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		saveTestMessage(t, db, fmt.Sprintf("Message %d", i))
+	}
+
+	resp := doRequest(t, http.MethodDelete, ts.URL+"/api/messages")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("expected 0 messages, got %d", len(messages))
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	saveTestMessage(t, db, "Password reset")
+	saveTestMessage(t, db, "Welcome aboard")
+	saveTestMessage(t, db, "Password changed")
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/messages/search?q=Password")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var list messageListResponse
+	decodeJSON(t, resp, &list)
+
+	if list.Total != 2 {
+		t.Errorf("expected 2 results, got %d", list.Total)
+	}
+
+	resp = doRequest(t, http.MethodGet, ts.URL+"/api/messages/search")
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 without search term, got %d", resp.StatusCode)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+
+	now := time.Now()
+	for _, rcpt := range []string{"passed@example.com", "pending@example.com"} {
+		if _, err := db.RecordGreylistAttempt("10.0.0.1", "sender@example.com", rcpt, now, time.Minute, time.Hour); err != nil {
+			t.Fatalf("failed to record attempt: %v", err)
+		}
+	}
+	if _, err := db.RecordGreylistAttempt("10.0.0.1", "sender@example.com", "passed@example.com", now.Add(2*time.Minute), time.Minute, time.Hour); err != nil {
+		t.Fatalf("failed to record attempt: %v", err)
+	}
+
+	resp := doRequest(t, http.MethodGet, ts.URL+"/api/greylist?pending=true")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var pending greylistResponse
+	decodeJSON(t, resp, &pending)
+	if len(pending.Entries) != 1 || pending.Entries[0].Recipient != "pending@example.com" || pending.Entries[0].Status != "pending" {
+		t.Errorf("expected only the pending triplet, got %+v", pending.Entries)
+	}
+
+	resp = doRequest(t, http.MethodGet, ts.URL+"/api/greylist")
+	var all greylistResponse
+	decodeJSON(t, resp, &all)
+	if len(all.Entries) != 2 {
+		t.Fatalf("expected 2 triplets, got %d", len(all.Entries))
+	}
+	if all.Entries[0].Status != "passed" || all.Entries[0].PassedAt == nil || all.Entries[0].Attempts != 2 {
+		t.Errorf("expected the most recent triplet to have passed, got %+v", all.Entries[0])
+	}
+
+	resp = doRequest(t, http.MethodDelete, ts.URL+"/api/greylist")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	entries, err := db.ListGreylist(false)
+	if err != nil {
+		t.Fatalf("failed to list greylist: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the greylist to be cleared, got %d entries", len(entries))
+	}
+}
+
+func TestReleaseMessage(t *testing.T) {
+	ts, db, cleanup := setupTestAPI(t)
+	defer cleanup()
+	msg := saveTestMessage(t, db, "Release")
+
+	resp := doRequest(t, http.MethodPost, fmt.Sprintf("%s/api/messages/%d/release", ts.URL, msg.ID))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without an upstream server, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	// DevSmtp itself is the upstream server
+	upstreamDB, err := database.New(filepath.Join(t.TempDir(), "upstream.db"))
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer upstreamDB.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	upstream, err := smtp.NewServer(&config.Config{}, upstreamDB, smtp.NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create upstream server: %v", err)
+	}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	cfg := &config.Config{Relay: config.RelayConfig{
+		Host:      "127.0.0.1",
+		Port:      listener.Addr().(*net.TCPAddr).Port,
+		TLS:       config.ListenerPlain,
+		ReleaseTo: []string{"inbox@example.com", "other@example.com"},
+		Timeout:   2 * time.Second,
+	}}
+	rts := httptest.NewServer(NewServer(cfg, db, smtp.NewLogger(100)).Handler())
+	defer rts.Close()
+	url := fmt.Sprintf("%s/api/messages/%d/release", rts.URL, msg.ID)
+
+	// Only addresses in relay.release_to may be used
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"to": ["inbox@example.com", "anyone@elsewhere.test"]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for a recipient outside relay.release_to, got %d", resp.StatusCode)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Post(url, "application/json", strings.NewReader(`{"to": ["INBOX@example.com"]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var released releaseResponse
+	decodeJSON(t, resp, &released)
+	if released.ID != msg.ID || len(released.To) != 1 || released.To[0] != "INBOX@example.com" {
+		t.Errorf("unexpected response: %+v", released)
+	}
+
+	messages, err := upstreamDB.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Subject != "Release" || messages[0].Recipients != "INBOX@example.com" {
+		t.Fatalf("expected the message to reach the upstream server, got %+v", messages)
+	}
+}
@@ -0,0 +1,98 @@
+package attachment
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+var ErrNotFound = errors.New("attachment not found")
+
+// Name returns the filename to show and save a part under, making one up
+// from the section path and content type when the sender did not supply one.
+func Name(part database.Part) string {
+	name := filepath.Base(strings.ReplaceAll(part.Filename, "\\", "/"))
+	if name != "" && name != "." && name != "/" && name != ".." {
+		return name
+	}
+
+	ext := ""
+	if exts, err := mime.ExtensionsByType(part.ContentType); err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	return "part-" + strings.ReplaceAll(part.Path, ".", "-") + ext
+}
+
+// Find selects an attachment by its 1-based index in the list or by filename.
+func Find(attachments []database.Part, ref string) (*database.Part, error) {
+	if idx, err := strconv.Atoi(ref); err == nil {
+		if idx < 1 || idx > len(attachments) {
+			return nil, fmt.Errorf("%w: index %d out of range (1-%d)", ErrNotFound, idx, len(attachments))
+		}
+		return &attachments[idx-1], nil
+	}
+
+	for i := range attachments {
+		if Name(attachments[i]) == ref {
+			return &attachments[i], nil
+		}
+	}
+	for i := range attachments {
+		if strings.EqualFold(Name(attachments[i]), ref) {
+			return &attachments[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no attachment named %q", ErrNotFound, ref)
+}
+
+// Save writes the attachment into dir without overwriting existing files and
+// returns the path it was written to.
+func Save(dir string, part database.Part) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	name := Name(part)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := f.Write(part.Data); err != nil {
+			f.Close()
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+func FormatSize(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
@@ -0,0 +1,119 @@
+package attachment
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+func testAttachments() []database.Part {
+	return []database.Part{
+		{Path: "2", ContentType: "application/pdf", Filename: "invoice.pdf", Data: []byte("%PDF-1.4")},
+		{Path: "3", ContentType: "text/calendar", Filename: "Invite.ics", Data: []byte("BEGIN:VCALENDAR")},
+		{Path: "4.1", ContentType: "image/png", Data: []byte("png")},
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		part     database.Part
+		expected string
+	}{
+		{database.Part{Filename: "report.pdf"}, "report.pdf"},
+		{database.Part{Filename: "../../etc/passwd"}, "passwd"},
+		{database.Part{Filename: `C:\Users\me\file.txt`}, "file.txt"},
+		{database.Part{Path: "4.1", ContentType: "image/png"}, "part-4-1.png"},
+		{database.Part{Path: "2", ContentType: "application/x-unknown-type"}, "part-2"},
+	}
+
+	for _, tt := range tests {
+		if got := Name(tt.part); got != tt.expected {
+			t.Errorf("Name(%+v) = %q, expected %q", tt.part, got, tt.expected)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	attachments := testAttachments()
+
+	part, err := Find(attachments, "2")
+	if err != nil {
+		t.Fatalf("failed to find by index: %v", err)
+	}
+	if part.Filename != "Invite.ics" {
+		t.Errorf("expected Invite.ics, got %q", part.Filename)
+	}
+
+	part, err = Find(attachments, "invite.ics")
+	if err != nil {
+		t.Fatalf("failed to find by name: %v", err)
+	}
+	if part.Path != "3" {
+		t.Errorf("expected part 3, got %q", part.Path)
+	}
+
+	part, err = Find(attachments, "part-4-1.png")
+	if err != nil {
+		t.Fatalf("failed to find by generated name: %v", err)
+	}
+	if part.Path != "4.1" {
+		t.Errorf("expected part 4.1, got %q", part.Path)
+	}
+
+	if _, err := Find(attachments, "4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for out of range index, got %v", err)
+	}
+	if _, err := Find(attachments, "missing.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown name, got %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "attachments")
+	part := testAttachments()[0]
+
+	path, err := Save(dir, part)
+	if err != nil {
+		t.Fatalf("failed to save attachment: %v", err)
+	}
+	if path != filepath.Join(dir, "invoice.pdf") {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read saved file: %v", err)
+	}
+	if string(data) != "%PDF-1.4" {
+		t.Errorf("unexpected file content: %q", data)
+	}
+
+	// Saving again must not overwrite the first copy
+	path, err = Save(dir, part)
+	if err != nil {
+		t.Fatalf("failed to save attachment again: %v", err)
+	}
+	if path != filepath.Join(dir, "invoice (1).pdf") {
+		t.Errorf("unexpected path for second copy: %s", path)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int
+		expected string
+	}{
+		{512, "512 bytes"},
+		{2048, "2.0 KB"},
+		{3 * 1024 * 1024, "3.0 MB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatSize(tt.size); got != tt.expected {
+			t.Errorf("FormatSize(%d) = %q, expected %q", tt.size, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	caFile    = "ca.pem"
+	caKeyFile = "ca-key.pem"
+	certFile  = "cert.pem"
+	keyFile   = "key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+
+	// renewBefore is how close to expiry a cached server certificate is
+	// replaced instead of reused.
+	renewBefore = 30 * 24 * time.Hour
+)
+
+// Bundle is a development CA together with a server certificate it signed.
+// All fields are PEM encoded.
+type Bundle struct {
+	CACert []byte
+	CAKey  []byte
+	Cert   []byte
+	Key    []byte
+}
+
+// TLSCertificate returns the server certificate with the CA appended to the
+// chain, ready for use in a tls.Config.
+func (b *Bundle) TLSCertificate() (tls.Certificate, error) {
+	chain := append(append([]byte{}, b.Cert...), b.CACert...)
+	return tls.X509KeyPair(chain, b.Key)
+}
+
+// DefaultHosts returns the names a certificate for a server bound to
+// bindHosts should be valid for.
+func DefaultHosts(bindHosts ...string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	for _, bindHost := range bindHosts {
+		switch bindHost {
+		case "", "0.0.0.0", "::":
+		default:
+			hosts = append(hosts, bindHost)
+		}
+	}
+
+	var unique []string
+	for _, host := range hosts {
+		if !slices.Contains(unique, host) {
+			unique = append(unique, host)
+		}
+	}
+	return unique
+}
+
+// Generate creates a new CA and a server certificate for hosts, which may be
+// DNS names or IP addresses.
+func Generate(hosts []string) (*Bundle, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"DevSmtp"}, CommonName: "DevSmtp Development CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &Bundle{
+		CACert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		CAKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER}),
+	}
+	if err := bundle.issue(hosts); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// LoadOrCreate returns the bundle cached in dir, creating it on first use.
+// The CA is kept across runs so clients only have to trust it once; the
+// server certificate is reissued when it no longer covers hosts or is about
+// to expire. An empty dir generates a throwaway bundle in memory.
+func LoadOrCreate(dir string, hosts []string) (*Bundle, error) {
+	if dir == "" {
+		return Generate(hosts)
+	}
+
+	bundle, err := load(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if bundle, err = Generate(hosts); err != nil {
+			return nil, err
+		}
+		return bundle, bundle.save(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bundle.covers(hosts) {
+		return bundle, nil
+	}
+	if err := bundle.issue(hosts); err != nil {
+		return nil, err
+	}
+	return bundle, bundle.save(dir)
+}
+
+func load(dir string) (*Bundle, error) {
+	var bundle Bundle
+	for name, dest := range map[string]*[]byte{
+		caFile:    &bundle.CACert,
+		caKeyFile: &bundle.CAKey,
+		certFile:  &bundle.Cert,
+		keyFile:   &bundle.Key,
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		*dest = data
+	}
+	return &bundle, nil
+}
+
+func (b *Bundle) save(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	for _, file := range []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{caFile, b.CACert, 0o644},
+		{caKeyFile, b.CAKey, 0o600},
+		{certFile, b.Cert, 0o644},
+		{keyFile, b.Key, 0o600},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file.name), file.data, file.perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// covers reports whether the server certificate is valid for all hosts and
+// not close to expiry.
+func (b *Bundle) covers(hosts []string) bool {
+	cert, err := parseCert(b.Cert)
+	if err != nil || time.Until(cert.NotAfter) < renewBefore {
+		return false
+	}
+
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// issue creates a new server certificate for hosts signed by the bundle's CA.
+func (b *Bundle) issue(hosts []string) error {
+	ca, err := parseCert(b.CACert)
+	if err != nil {
+		return fmt.Errorf("invalid CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(b.CAKey)
+	if block == nil {
+		return errors.New("invalid CA key: no PEM data")
+	}
+	caKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid CA key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"DevSmtp"}, CommonName: "DevSmtp"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	b.Cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	b.Key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return nil
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
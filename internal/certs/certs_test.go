@@ -0,0 +1,133 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerateVerifiesAgainstCA(t *testing.T) {
+	bundle, err := Generate([]string{"localhost", "127.0.0.1", "mail.test"})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle.CACert) {
+		t.Fatal("failed to add CA to pool")
+	}
+
+	cert, err := parseCert(bundle.Cert)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "mail.test"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: pool}); err != nil {
+			t.Errorf("certificate does not verify for %s: %v", host, err)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: "other.test", Roots: pool}); err == nil {
+		t.Error("expected verification to fail for a host not in the SANs")
+	}
+
+	if _, err := bundle.TLSCertificate(); err != nil {
+		t.Errorf("failed to build TLS certificate: %v", err)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	bundle, err := Generate([]string{"localhost"})
+	if err != nil {
+		t.Fatalf("failed to generate: %v", err)
+	}
+	cert, err := bundle.TLSCertificate()
+	if err != nil {
+		t.Fatalf("failed to build TLS certificate: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle.CACert)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+port, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("handshake with trusted CA failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLoadOrCreateCaches(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+
+	first, err := LoadOrCreate(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	for _, name := range []string{caFile, caKeyFile, certFile, keyFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be written: %v", name, err)
+		}
+	}
+
+	second, err := LoadOrCreate(dir, []string{"localhost"})
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if !bytes.Equal(first.Cert, second.Cert) || !bytes.Equal(first.CACert, second.CACert) {
+		t.Error("expected the cached bundle to be reused")
+	}
+
+	// A new SAN reissues the server certificate but keeps the CA
+	third, err := LoadOrCreate(dir, []string{"localhost", "mail.test"})
+	if err != nil {
+		t.Fatalf("failed to reissue: %v", err)
+	}
+	if !bytes.Equal(first.CACert, third.CACert) {
+		t.Error("expected the CA to be kept")
+	}
+	if bytes.Equal(first.Cert, third.Cert) {
+		t.Error("expected a new server certificate")
+	}
+	if !third.covers([]string{"localhost", "mail.test"}) {
+		t.Error("expected the new certificate to cover both hosts")
+	}
+}
+
+func TestDefaultHosts(t *testing.T) {
+	hosts := DefaultHosts("192.168.1.10", "2001:db8::10")
+	for _, want := range []string{"localhost", "127.0.0.1", "::1", "192.168.1.10", "2001:db8::10"} {
+		found := false
+		for _, host := range hosts {
+			if host == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s in %v", want, hosts)
+		}
+	}
+
+	for _, host := range DefaultHosts("0.0.0.0", "::") {
+		if host == "0.0.0.0" || host == "::" {
+			t.Error("wildcard bind address must not be added as a SAN")
+		}
+	}
+}
@@ -1,38 +1,267 @@
 package config
 
 import (
+	"crypto/subtle"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	Auth     AuthConfig     `mapstructure:"auth"`
-	TLS      TLSConfig      `mapstructure:"tls"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Auth        AuthConfig        `mapstructure:"auth"`
+	TLS         TLSConfig         `mapstructure:"tls"`
+	API         APIConfig         `mapstructure:"api"`
+	Log         LogConfig         `mapstructure:"log"`
+	Headless    bool              `mapstructure:"headless"`
+	Attachments AttachmentsConfig `mapstructure:"attachments"`
+	DSN         DSNConfig         `mapstructure:"dsn"`
+	Faults      []FaultConfig     `mapstructure:"faults"`
+	Greylist    GreylistConfig    `mapstructure:"greylist"`
+	Limits      LimitsConfig      `mapstructure:"limits"`
+	Proxy       ProxyConfig       `mapstructure:"proxy_protocol"`
+	XClient     XClientConfig     `mapstructure:"xclient"`
+	Relay       RelayConfig       `mapstructure:"relay"`
+	Retention   RetentionConfig   `mapstructure:"retention"`
 }
 
 type ServerConfig struct {
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+	TLSPort int    `mapstructure:"tls_port"` // implicit TLS (SMTPS) listener, 0 disables it
+
+	// Listeners replaces Host, Port and TLSPort when set.
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+
+	MaxMessageSize int `mapstructure:"max_message_size"` // bytes, advertised with SIZE
+}
+
+// Listener modes.
+const (
+	ListenerPlain    = "plain"    // no TLS
+	ListenerStartTLS = "starttls" // STARTTLS is offered when a certificate is configured
+	ListenerTLS      = "tls"      // implicit TLS (SMTPS)
+)
+
+// ListenerConfig is a TCP address and port, a Unix socket Path, or a socket
+// passed in by systemd socket activation with FileDescriptorName FDName.
+type ListenerConfig struct {
+	Address      string `mapstructure:"address"` // IPv4 or IPv6 address or host name, empty for all interfaces
+	Port         int    `mapstructure:"port"`
+	Path         string `mapstructure:"path"`
+	FDName       string `mapstructure:"fd_name"`
+	Mode         string `mapstructure:"mode"`          // plain, starttls (default) or tls
+	AuthRequired *bool  `mapstructure:"auth_required"` // overrides auth.required
+}
+
+// Addr returns the listener's address for display: host:port with IPv6
+// literals bracketed, the socket path, or "systemd:" and the FDName.
+func (l ListenerConfig) Addr() string {
+	switch {
+	case l.FDName != "":
+		return "systemd:" + l.FDName
+	case l.Path != "":
+		return l.Path
+	default:
+		return net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+	}
+}
+
+// ListenerConfigs returns the configured listeners. Without Listeners, it
+// returns a STARTTLS listener on Host:Port and, if TLSPort is set, an
+// implicit TLS listener on Host:TLSPort. Empty modes default to starttls.
+func (s ServerConfig) ListenerConfigs() []ListenerConfig {
+	if len(s.Listeners) == 0 {
+		listeners := []ListenerConfig{{Address: s.Host, Port: s.Port, Mode: ListenerStartTLS}}
+		if s.TLSPort != 0 {
+			listeners = append(listeners, ListenerConfig{Address: s.Host, Port: s.TLSPort, Mode: ListenerTLS})
+		}
+		return listeners
+	}
+
+	listeners := make([]ListenerConfig, len(s.Listeners))
+	for i, l := range s.Listeners {
+		if l.Mode == "" {
+			l.Mode = ListenerStartTLS
+		}
+		l.Mode = strings.ToLower(l.Mode)
+		listeners[i] = l
+	}
+	return listeners
 }
 
 type DatabaseConfig struct {
 	Path string `mapstructure:"path"`
 }
 
+// RetentionConfig keeps the database from growing forever. Every Interval
+// the oldest messages beyond MaxMessages or MaxSize, and those older than
+// MaxAge, are deleted and the freed space is returned to the file system.
+// Zero disables a limit.
+type RetentionConfig struct {
+	MaxMessages int           `mapstructure:"max_messages"`
+	MaxAge      time.Duration `mapstructure:"max_age"`
+	MaxSize     int           `mapstructure:"max_size"` // bytes of raw message data
+	Interval    time.Duration `mapstructure:"interval"`
+}
+
 type AuthConfig struct {
-	Required bool   `mapstructure:"required"`
+	Required bool         `mapstructure:"required"`
+	Username string       `mapstructure:"username"`
+	Password string       `mapstructure:"password"`
+	Users    []UserConfig `mapstructure:"users"`
+	OAuth    OAuthConfig  `mapstructure:"oauth"`
+}
+
+type UserConfig struct {
 	Username string `mapstructure:"username"`
 	Password string `mapstructure:"password"`
 }
 
+// OAuthConfig enables XOAUTH2 and OAUTHBEARER. Mode is "any" (accept every
+// token), "static" (accept Tokens) or "regex" (accept tokens matching
+// Pattern); empty disables OAuth.
+type OAuthConfig struct {
+	Mode    string   `mapstructure:"mode"`
+	Tokens  []string `mapstructure:"tokens"`
+	Pattern string   `mapstructure:"pattern"`
+}
+
+// Credentials returns all configured users, including the single
+// username/password pair if set.
+func (a AuthConfig) Credentials() []UserConfig {
+	var users []UserConfig
+	if a.Username != "" {
+		users = append(users, UserConfig{Username: a.Username, Password: a.Password})
+	}
+	for _, user := range a.Users {
+		if user.Username != "" {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// Verify reports whether username and password match a configured user.
+func (a AuthConfig) Verify(username, password string) bool {
+	for _, user := range a.Credentials() {
+		if user.Username == username && subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 type TLSConfig struct {
 	Cert string `mapstructure:"cert"`
 	Key  string `mapstructure:"key"`
+
+	// Auto generates a self-signed certificate when no cert/key is given.
+	// AutoHosts defaults to localhost and the bind hosts; without AutoDir the
+	// certificate only lives in memory.
+	Auto      bool     `mapstructure:"auto"`
+	AutoHosts []string `mapstructure:"auto_hosts"`
+	AutoDir   string   `mapstructure:"auto_dir"`
+}
+
+type APIConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+}
+
+type LogConfig struct {
+	Format string `mapstructure:"format"` // plain or json, used in headless mode
+}
+
+type AttachmentsConfig struct {
+	Dir string `mapstructure:"dir"` // where saved attachments are written
+}
+
+// DSNConfig simulates delivery failures. Messages are still captured, but
+// recipients matching FailRecipients (shell patterns such as
+// "*@bounce.test") get a failure report sent back to the sender.
+type DSNConfig struct {
+	FailRecipients []string `mapstructure:"fail_recipients"`
+}
+
+// LimitsConfig bounds what clients may use. Rates are counted per client IP
+// over a sliding minute; the timeouts follow RFC 5321 section 4.5.3.2. Zero
+// disables a limit.
+type LimitsConfig struct {
+	MaxSessions          int           `mapstructure:"max_sessions"`
+	ConnectionsPerMinute int           `mapstructure:"connections_per_minute"`
+	MessagesPerMinute    int           `mapstructure:"messages_per_minute"`
+	CommandTimeout       time.Duration `mapstructure:"command_timeout"` // waiting for a command or reply
+	DataTimeout          time.Duration `mapstructure:"data_timeout"`    // waiting for the next block of DATA or BDAT
+}
+
+// ProxyConfig enables the HAProxy PROXY protocol (v1 and v2). Connections
+// from a Trusted address or CIDR must start with a PROXY header, which
+// supplies the client IP; other connections are treated as direct clients.
+type ProxyConfig struct {
+	Enabled bool     `mapstructure:"enabled"`
+	Trusted []string `mapstructure:"trusted"`
+}
+
+// XClientConfig lists the peers (addresses or CIDRs) allowed to use the
+// Postfix XCLIENT and XFORWARD extensions. Both are off when it is empty.
+type XClientConfig struct {
+	Trusted []string `mapstructure:"trusted"`
+}
+
+// RelayConfig is the upstream SMTP server captured messages are released
+// to. TLS is one of the listener modes: plain, starttls (required) or tls.
+// Messages are sent as Sender, or their original envelope sender if it is
+// empty. Recipients matching AutoRelay (shell patterns, as in
+// dsn.fail_recipients) are relayed as soon as a message is captured.
+type RelayConfig struct {
+	Host               string        `mapstructure:"host"`
+	Port               int           `mapstructure:"port"`
+	Username           string        `mapstructure:"username"`
+	Password           string        `mapstructure:"password"`
+	TLS                string        `mapstructure:"tls"`
+	InsecureSkipVerify bool          `mapstructure:"insecure_skip_verify"`
+	Sender             string        `mapstructure:"sender"`
+	ReleaseTo          []string      `mapstructure:"release_to"` // used when a release names no recipients
+	AutoRelay          []string      `mapstructure:"auto_relay"`
+	Timeout            time.Duration `mapstructure:"timeout"`
+}
+
+// GreylistConfig enables greylisting: the first attempt for each (client IP,
+// sender, recipient) triplet is rejected with 451, and retries are accepted
+// once Delay has passed. Pending triplets not retried within Expire start
+// over.
+type GreylistConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Delay   time.Duration `mapstructure:"delay"`
+	Expire  time.Duration `mapstructure:"expire"`
+}
+
+// FaultConfig is a fault injection rule. A rule matches when all of its
+// conditions hold; Command is an SMTP verb or DATA_END (after the message
+// content arrives), and Every matches every Nth message. The first matching
+// rule waits Delay, then replies Code and Message if Code is set, and closes
+// the connection if Disconnect is set.
+type FaultConfig struct {
+	Command   string `mapstructure:"command"`
+	Sender    string `mapstructure:"sender"`    // regular expression
+	Recipient string `mapstructure:"recipient"` // regular expression
+	ClientIP  string `mapstructure:"client_ip"` // address or CIDR
+	AuthUser  string `mapstructure:"auth_user"`
+	Every     int    `mapstructure:"every"`
+
+	Code                 int           `mapstructure:"code"`
+	Message              string        `mapstructure:"message"`
+	Delay                time.Duration `mapstructure:"delay"`
+	Disconnect           bool          `mapstructure:"disconnect"`
+	DisconnectAfterBytes int           `mapstructure:"disconnect_after_bytes"` // DATA and BDAT only
 }
 
 func Load(cfgFile string, cmd *cobra.Command) (*Config, error) {
@@ -41,12 +270,50 @@ func Load(cfgFile string, cmd *cobra.Command) (*Config, error) {
 	// Set defaults
 	v.SetDefault("server.host", "0.0.0.0")
 	v.SetDefault("server.port", 587)
+	v.SetDefault("server.tls_port", 0)
+	v.SetDefault("server.max_message_size", 10485760)
 	v.SetDefault("database.path", "./devsmtp.db")
+	v.SetDefault("retention.max_messages", 0)
+	v.SetDefault("retention.max_age", "0s")
+	v.SetDefault("retention.max_size", 0)
+	v.SetDefault("retention.interval", "1m")
 	v.SetDefault("auth.required", false)
 	v.SetDefault("auth.username", "")
 	v.SetDefault("auth.password", "")
+	v.SetDefault("auth.oauth.mode", "")
 	v.SetDefault("tls.cert", "")
 	v.SetDefault("tls.key", "")
+	v.SetDefault("tls.auto", false)
+	v.SetDefault("tls.auto_hosts", []string{})
+	v.SetDefault("tls.auto_dir", "")
+	v.SetDefault("api.enabled", true)
+	v.SetDefault("api.host", "127.0.0.1")
+	v.SetDefault("api.port", 8025)
+	v.SetDefault("log.format", "plain")
+	v.SetDefault("headless", false)
+	v.SetDefault("attachments.dir", "./attachments")
+	v.SetDefault("dsn.fail_recipients", []string{})
+	v.SetDefault("greylist.enabled", false)
+	v.SetDefault("greylist.delay", "5m")
+	v.SetDefault("greylist.expire", "24h")
+	v.SetDefault("limits.max_sessions", 0)
+	v.SetDefault("limits.connections_per_minute", 0)
+	v.SetDefault("limits.messages_per_minute", 0)
+	v.SetDefault("limits.command_timeout", "5m")
+	v.SetDefault("limits.data_timeout", "3m")
+	v.SetDefault("proxy_protocol.enabled", false)
+	v.SetDefault("proxy_protocol.trusted", []string{})
+	v.SetDefault("xclient.trusted", []string{})
+	v.SetDefault("relay.host", "")
+	v.SetDefault("relay.port", 587)
+	v.SetDefault("relay.username", "")
+	v.SetDefault("relay.password", "")
+	v.SetDefault("relay.tls", ListenerStartTLS)
+	v.SetDefault("relay.insecure_skip_verify", false)
+	v.SetDefault("relay.sender", "")
+	v.SetDefault("relay.release_to", []string{})
+	v.SetDefault("relay.auto_relay", []string{})
+	v.SetDefault("relay.timeout", "30s")
 
 	// Config file
 	if cfgFile != "" {
@@ -73,9 +340,21 @@ func Load(cfgFile string, cmd *cobra.Command) (*Config, error) {
 		if flag := cmd.Flags().Lookup("port"); flag != nil {
 			_ = v.BindPFlag("server.port", flag)
 		}
+		if flag := cmd.Flags().Lookup("tls-port"); flag != nil {
+			_ = v.BindPFlag("server.tls_port", flag)
+		}
+		if flag := cmd.Flags().Lookup("max-message-size"); flag != nil {
+			_ = v.BindPFlag("server.max_message_size", flag)
+		}
 		if flag := cmd.Flags().Lookup("db"); flag != nil {
 			_ = v.BindPFlag("database.path", flag)
 		}
+		if flag := cmd.Flags().Lookup("max-messages"); flag != nil {
+			_ = v.BindPFlag("retention.max_messages", flag)
+		}
+		if flag := cmd.Flags().Lookup("max-age"); flag != nil {
+			_ = v.BindPFlag("retention.max_age", flag)
+		}
 		if flag := cmd.Flags().Lookup("auth-required"); flag != nil {
 			_ = v.BindPFlag("auth.required", flag)
 		}
@@ -91,6 +370,57 @@ func Load(cfgFile string, cmd *cobra.Command) (*Config, error) {
 		if flag := cmd.Flags().Lookup("tls-key"); flag != nil {
 			_ = v.BindPFlag("tls.key", flag)
 		}
+		if flag := cmd.Flags().Lookup("tls-auto"); flag != nil {
+			_ = v.BindPFlag("tls.auto", flag)
+		}
+		if flag := cmd.Flags().Lookup("tls-auto-dir"); flag != nil {
+			_ = v.BindPFlag("tls.auto_dir", flag)
+		}
+		if flag := cmd.Flags().Lookup("api"); flag != nil {
+			_ = v.BindPFlag("api.enabled", flag)
+		}
+		if flag := cmd.Flags().Lookup("api-host"); flag != nil {
+			_ = v.BindPFlag("api.host", flag)
+		}
+		if flag := cmd.Flags().Lookup("api-port"); flag != nil {
+			_ = v.BindPFlag("api.port", flag)
+		}
+		if flag := cmd.Flags().Lookup("log-format"); flag != nil {
+			_ = v.BindPFlag("log.format", flag)
+		}
+		if flag := cmd.Flags().Lookup("headless"); flag != nil {
+			_ = v.BindPFlag("headless", flag)
+		}
+		if flag := cmd.Flags().Lookup("attachment-dir"); flag != nil {
+			_ = v.BindPFlag("attachments.dir", flag)
+		}
+		if flag := cmd.Flags().Lookup("max-sessions"); flag != nil {
+			_ = v.BindPFlag("limits.max_sessions", flag)
+		}
+		if flag := cmd.Flags().Lookup("proxy-protocol"); flag != nil {
+			_ = v.BindPFlag("proxy_protocol.enabled", flag)
+		}
+		if flag := cmd.Flags().Lookup("proxy-trusted"); flag != nil {
+			_ = v.BindPFlag("proxy_protocol.trusted", flag)
+		}
+		if flag := cmd.Flags().Lookup("xclient-trusted"); flag != nil {
+			_ = v.BindPFlag("xclient.trusted", flag)
+		}
+		if flag := cmd.Flags().Lookup("relay-host"); flag != nil {
+			_ = v.BindPFlag("relay.host", flag)
+		}
+		if flag := cmd.Flags().Lookup("relay-port"); flag != nil {
+			_ = v.BindPFlag("relay.port", flag)
+		}
+		if flag := cmd.Flags().Lookup("relay-auto"); flag != nil {
+			_ = v.BindPFlag("relay.auto_relay", flag)
+		}
+		if flag := cmd.Flags().Lookup("greylist"); flag != nil {
+			_ = v.BindPFlag("greylist.enabled", flag)
+		}
+		if flag := cmd.Flags().Lookup("greylist-delay"); flag != nil {
+			_ = v.BindPFlag("greylist.delay", flag)
+		}
 	}
 
 	// Handle environment variable overrides explicitly
@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLoadDefaults(t *testing.T) {
@@ -26,6 +28,12 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.Server.Port != 587 {
 		t.Errorf("expected default port 587, got %d", cfg.Server.Port)
 	}
+	if cfg.Server.TLSPort != 0 {
+		t.Errorf("expected implicit TLS to be disabled by default, got port %d", cfg.Server.TLSPort)
+	}
+	if cfg.Server.MaxMessageSize != 10485760 {
+		t.Errorf("expected default max_message_size 10485760, got %d", cfg.Server.MaxMessageSize)
+	}
 	if cfg.Database.Path != "./devsmtp.db" {
 		t.Errorf("expected default db path './devsmtp.db', got %q", cfg.Database.Path)
 	}
@@ -44,6 +52,36 @@ func TestLoadDefaults(t *testing.T) {
 	if cfg.TLS.Key != "" {
 		t.Errorf("expected default tls.key '', got %q", cfg.TLS.Key)
 	}
+	if cfg.API.Enabled != true {
+		t.Errorf("expected default api.enabled true, got %v", cfg.API.Enabled)
+	}
+	if cfg.API.Host != "127.0.0.1" {
+		t.Errorf("expected default api.host '127.0.0.1', got %q", cfg.API.Host)
+	}
+	if cfg.API.Port != 8025 {
+		t.Errorf("expected default api.port 8025, got %d", cfg.API.Port)
+	}
+	if cfg.Log.Format != "plain" {
+		t.Errorf("expected default log.format 'plain', got %q", cfg.Log.Format)
+	}
+	if cfg.Headless != false {
+		t.Errorf("expected default headless false, got %v", cfg.Headless)
+	}
+	if cfg.Attachments.Dir != "./attachments" {
+		t.Errorf("expected default attachments.dir './attachments', got %q", cfg.Attachments.Dir)
+	}
+	if cfg.Greylist.Enabled || cfg.Greylist.Delay != 5*time.Minute || cfg.Greylist.Expire != 24*time.Hour {
+		t.Errorf("unexpected greylist defaults: %+v", cfg.Greylist)
+	}
+	if cfg.Limits.MaxSessions != 0 || cfg.Limits.CommandTimeout != 5*time.Minute || cfg.Limits.DataTimeout != 3*time.Minute {
+		t.Errorf("unexpected limits defaults: %+v", cfg.Limits)
+	}
+	if cfg.Proxy.Enabled || len(cfg.Proxy.Trusted) != 0 {
+		t.Errorf("unexpected proxy_protocol defaults: %+v", cfg.Proxy)
+	}
+	if len(cfg.XClient.Trusted) != 0 {
+		t.Errorf("expected no xclient.trusted by default, got %v", cfg.XClient.Trusted)
+	}
 }
 
 func TestLoadFromEnvVars(t *testing.T) {
@@ -82,6 +120,8 @@ func TestLoadFromConfigFile(t *testing.T) {
 server:
   host: "10.0.0.1"
   port: 1025
+  tls_port: 1465
+  max_message_size: 2048
 
 database:
   path: "/var/lib/devsmtp/mail.db"
@@ -90,10 +130,65 @@ auth:
   required: true
   username: "testuser"
   password: "testpass"
+  users:
+    - username: "team-a"
+      password: "secret-a"
+    - username: "team-b"
+      password: "secret-b"
+  oauth:
+    mode: "regex"
+    pattern: "^ya29\\."
 
 tls:
   cert: "/etc/ssl/cert.pem"
   key: "/etc/ssl/key.pem"
+
+api:
+  enabled: false
+  host: "127.0.0.1"
+  port: 9025
+
+log:
+  format: "json"
+
+headless: true
+
+attachments:
+  dir: "/tmp/attachments"
+
+dsn:
+  fail_recipients:
+    - "*@bounce.test"
+
+faults:
+  - command: "RCPT"
+    recipient: "^busy@"
+    code: 450
+    message: "4.2.1 Mailbox busy"
+  - command: "DATA_END"
+    every: 3
+    delay: "1500ms"
+    disconnect: true
+
+greylist:
+  enabled: true
+  delay: "30s"
+
+limits:
+  max_sessions: 20
+  connections_per_minute: 60
+  messages_per_minute: 10
+  command_timeout: "1m"
+  data_timeout: "30s"
+
+proxy_protocol:
+  enabled: true
+  trusted:
+    - "10.0.0.0/8"
+    - "192.168.1.5"
+
+xclient:
+  trusted: ["127.0.0.1", "::1"]
 `
 
 	if _, err := tmpFile.WriteString(configContent); err != nil {
@@ -117,6 +212,12 @@ tls:
 	if cfg.Server.Port != 1025 {
 		t.Errorf("expected port 1025, got %d", cfg.Server.Port)
 	}
+	if cfg.Server.TLSPort != 1465 {
+		t.Errorf("expected tls_port 1465, got %d", cfg.Server.TLSPort)
+	}
+	if cfg.Server.MaxMessageSize != 2048 {
+		t.Errorf("expected max_message_size 2048, got %d", cfg.Server.MaxMessageSize)
+	}
 	if cfg.Database.Path != "/var/lib/devsmtp/mail.db" {
 		t.Errorf("expected db path '/var/lib/devsmtp/mail.db', got %q", cfg.Database.Path)
 	}
@@ -129,12 +230,67 @@ tls:
 	if cfg.Auth.Password != "testpass" {
 		t.Errorf("expected auth.password 'testpass', got %q", cfg.Auth.Password)
 	}
+	if len(cfg.Auth.Users) != 2 || cfg.Auth.Users[1].Username != "team-b" || cfg.Auth.Users[1].Password != "secret-b" {
+		t.Errorf("expected two auth.users, got %+v", cfg.Auth.Users)
+	}
+	if cfg.Auth.OAuth.Mode != "regex" || cfg.Auth.OAuth.Pattern != `^ya29\.` {
+		t.Errorf("unexpected auth.oauth: %+v", cfg.Auth.OAuth)
+	}
 	if cfg.TLS.Cert != "/etc/ssl/cert.pem" {
 		t.Errorf("expected tls.cert '/etc/ssl/cert.pem', got %q", cfg.TLS.Cert)
 	}
 	if cfg.TLS.Key != "/etc/ssl/key.pem" {
 		t.Errorf("expected tls.key '/etc/ssl/key.pem', got %q", cfg.TLS.Key)
 	}
+	if cfg.API.Enabled != false {
+		t.Errorf("expected api.enabled false, got %v", cfg.API.Enabled)
+	}
+	if cfg.API.Host != "127.0.0.1" {
+		t.Errorf("expected api.host '127.0.0.1', got %q", cfg.API.Host)
+	}
+	if cfg.API.Port != 9025 {
+		t.Errorf("expected api.port 9025, got %d", cfg.API.Port)
+	}
+	if cfg.Log.Format != "json" {
+		t.Errorf("expected log.format 'json', got %q", cfg.Log.Format)
+	}
+	if cfg.Headless != true {
+		t.Errorf("expected headless true, got %v", cfg.Headless)
+	}
+	if cfg.Attachments.Dir != "/tmp/attachments" {
+		t.Errorf("expected attachments.dir '/tmp/attachments', got %q", cfg.Attachments.Dir)
+	}
+	if len(cfg.DSN.FailRecipients) != 1 || cfg.DSN.FailRecipients[0] != "*@bounce.test" {
+		t.Errorf("expected dsn.fail_recipients [*@bounce.test], got %v", cfg.DSN.FailRecipients)
+	}
+	if len(cfg.Faults) != 2 {
+		t.Fatalf("expected 2 faults, got %d", len(cfg.Faults))
+	}
+	if cfg.Faults[0].Recipient != "^busy@" || cfg.Faults[0].Code != 450 || cfg.Faults[0].Message != "4.2.1 Mailbox busy" {
+		t.Errorf("unexpected first fault: %+v", cfg.Faults[0])
+	}
+	if cfg.Faults[1].Every != 3 || cfg.Faults[1].Delay != 1500*time.Millisecond || !cfg.Faults[1].Disconnect {
+		t.Errorf("unexpected second fault: %+v", cfg.Faults[1])
+	}
+	if !cfg.Greylist.Enabled || cfg.Greylist.Delay != 30*time.Second || cfg.Greylist.Expire != 24*time.Hour {
+		t.Errorf("unexpected greylist: %+v", cfg.Greylist)
+	}
+	expectedLimits := LimitsConfig{
+		MaxSessions:          20,
+		ConnectionsPerMinute: 60,
+		MessagesPerMinute:    10,
+		CommandTimeout:       time.Minute,
+		DataTimeout:          30 * time.Second,
+	}
+	if cfg.Limits != expectedLimits {
+		t.Errorf("expected limits %+v, got %+v", expectedLimits, cfg.Limits)
+	}
+	if !cfg.Proxy.Enabled || len(cfg.Proxy.Trusted) != 2 || cfg.Proxy.Trusted[1] != "192.168.1.5" {
+		t.Errorf("unexpected proxy_protocol: %+v", cfg.Proxy)
+	}
+	if len(cfg.XClient.Trusted) != 2 || cfg.XClient.Trusted[1] != "::1" {
+		t.Errorf("unexpected xclient.trusted: %v", cfg.XClient.Trusted)
+	}
 }
 
 func TestEnvOverridesConfigFile(t *testing.T) {
@@ -251,3 +407,90 @@ func TestMissingConfigFileUsesDefaults(t *testing.T) {
 		t.Errorf("expected default port, got %d", cfg.Server.Port)
 	}
 }
+
+func TestAuthCredentials(t *testing.T) {
+	auth := AuthConfig{
+		Username: "legacy",
+		Password: "pass",
+		Users: []UserConfig{
+			{Username: "team-a", Password: "secret-a"},
+			{Username: "", Password: "ignored"},
+		},
+	}
+
+	if got := len(auth.Credentials()); got != 2 {
+		t.Errorf("expected 2 credentials, got %d", got)
+	}
+	if !auth.Verify("legacy", "pass") || !auth.Verify("team-a", "secret-a") {
+		t.Error("expected configured users to verify")
+	}
+	if auth.Verify("team-a", "pass") || auth.Verify("", "ignored") {
+		t.Error("expected wrong credentials to be rejected")
+	}
+}
+
+func TestListenerConfigs(t *testing.T) {
+	server := ServerConfig{Host: "0.0.0.0", Port: 587, TLSPort: 465}
+	expected := []ListenerConfig{
+		{Address: "0.0.0.0", Port: 587, Mode: ListenerStartTLS},
+		{Address: "0.0.0.0", Port: 465, Mode: ListenerTLS},
+	}
+	if listeners := server.ListenerConfigs(); !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("expected %+v, got %+v", expected, listeners)
+	}
+
+	tmpFile, err := os.CreateTemp("", "devsmtp-config-*.yaml")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	configContent := `
+server:
+  listeners:
+    - address: "0.0.0.0"
+      port: 25
+      mode: "plain"
+      auth_required: false
+    - address: "::"
+      port: 587
+    - address: "::1"
+      port: 465
+      mode: "TLS"
+    - path: "/run/devsmtp/smtp.sock"
+      mode: "plain"
+    - fd_name: "devsmtp.socket"
+`
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	tmpFile.Close()
+
+	cfg, err := Load(tmpFile.Name(), nil)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	listeners := cfg.Server.ListenerConfigs()
+	if len(listeners) != 5 {
+		t.Fatalf("expected 5 listeners, got %+v", listeners)
+	}
+	if listeners[0].Mode != ListenerPlain || listeners[0].AuthRequired == nil || *listeners[0].AuthRequired {
+		t.Errorf("unexpected first listener: %+v", listeners[0])
+	}
+	if listeners[1].Mode != ListenerStartTLS || listeners[1].AuthRequired != nil {
+		t.Errorf("unexpected second listener: %+v", listeners[1])
+	}
+	if listeners[2].Mode != ListenerTLS {
+		t.Errorf("expected the third listener to use implicit TLS, got %+v", listeners[2])
+	}
+	if addr := listeners[1].Addr(); addr != "[::]:587" {
+		t.Errorf("expected address [::]:587, got %q", addr)
+	}
+	if addr := listeners[3].Addr(); addr != "/run/devsmtp/smtp.sock" {
+		t.Errorf("expected the socket path, got %q", addr)
+	}
+	if addr := listeners[4].Addr(); addr != "systemd:devsmtp.socket" || listeners[4].Mode != ListenerStartTLS {
+		t.Errorf("unexpected socket activation listener: %+v", listeners[4])
+	}
+}
@@ -2,6 +2,8 @@ package database
 
 import (
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -12,54 +14,113 @@ type DB struct {
 }
 
 type Message struct {
-	ID         int64
-	Sender     string
-	Recipients string
-	Subject    string
-	Body       string
-	RawData    []byte
-	Size       int
-	ClientIP   string
-	IsRead     bool
-	CreatedAt  time.Time
+	ID            int64
+	Sender        string
+	Recipients    string
+	Subject       string
+	Body          string
+	HTMLBody      string
+	RawData       []byte
+	Size          int
+	ClientIP      string
+	ClientName    string // client hostname, as reported by XCLIENT or XFORWARD
+	AuthUser      string // SMTP AUTH username, empty for unauthenticated sessions
+	SMTPUTF8      bool   // the transaction used the SMTPUTF8 extension
+	Helo          string // HELO/EHLO name given by the client
+	MailParams    string // MAIL FROM parameters as sent, e.g. "SIZE=1024 BODY=8BITMIME"
+	TLS           bool   // the transaction ran over TLS
+	Authenticated bool   // the session used SMTP AUTH
+	IsRead        bool
+	CreatedAt     time.Time
+	Parts         []Part // only populated when saving; use GetParts to load
+
+	// DSN parameters from MAIL FROM (RFC 3461) and one entry per RCPT TO.
+	// EnvelopeRecipients and HeaderRecipients are only populated when
+	// saving; use GetRecipients.
+	DSNRet             string
+	DSNEnvID           string
+	EnvelopeRecipients []Recipient
+	HeaderRecipients   []Recipient
+
+	// Decoded message headers, as opposed to the SMTP envelope above. The
+	// Raw* fields keep the headers exactly as received.
+	From       string
+	To         string
+	Cc         string
+	ReplyTo    string
+	RawSubject string
+	RawFrom    string
+	RawTo      string
+	RawCc      string
+	RawReplyTo string
+}
+
+// Recipient types. RCPT TO addresses are stored as RecipientRcpt; the others
+// are parsed from the message headers.
+const (
+	RecipientRcpt = "rcpt"
+	RecipientTo   = "to"
+	RecipientCc   = "cc"
+	RecipientBcc  = "bcc"
+)
+
+type Recipient struct {
+	ID        int64
+	MessageID int64
+	Type      string // one of the Recipient* constants
+	Address   string
+	Notify    string // NOTIFY parameter, e.g. "SUCCESS,FAILURE" or "NEVER"
+	ORCPT     string // ORCPT parameter as "addr-type;address", xtext decoded
+}
+
+type Part struct {
+	ID           int64
+	MessageID    int64
+	Path         string
+	ContentType  string
+	Charset      string
+	Filename     string
+	ContentID    string
+	Disposition  string
+	IsAttachment bool
+	Size         int
+	Data         []byte
 }
 
+// New opens the database at path and brings its schema up to date. It
+// refuses databases written by a newer version of DevSmtp.
 func New(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path)
+	db, err := Open(path)
 	if err != nil {
 		return nil, err
 	}
 
-	db := &DB{conn: conn}
-	if err := db.migrate(); err != nil {
-		conn.Close()
+	if _, err := db.Migrate(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func (db *DB) migrate() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		sender TEXT NOT NULL,
-		recipients TEXT NOT NULL,
-		subject TEXT,
-		body TEXT,
-		raw_data BLOB,
-		size INTEGER NOT NULL DEFAULT 0,
-		client_ip TEXT,
-		is_read BOOLEAN NOT NULL DEFAULT 0,
-		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at);
-	CREATE INDEX IF NOT EXISTS idx_messages_is_read ON messages(is_read);
-	`
+// Open opens the database at path without migrating it, for inspecting the
+// schema version.
+func Open(path string) (*DB, error) {
+	conn, err := sql.Open("sqlite3", dsn(path))
+	if err != nil {
+		return nil, err
+	}
+	return &DB{conn: conn}, nil
+}
 
-	_, err := db.conn.Exec(schema)
-	return err
+func dsn(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	// Incremental auto-vacuum lets the retention janitor give freed pages
+	// back to the file system without rewriting the whole file.
+	return path + sep + "_foreign_keys=on&_auto_vacuum=incremental"
 }
 
 func (db *DB) Close() error {
@@ -67,19 +128,46 @@ func (db *DB) Close() error {
 }
 
 func (db *DB) SaveMessage(msg *Message) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-	INSERT INTO messages (sender, recipients, subject, body, raw_data, size, client_ip, is_read, created_at)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO messages (sender, recipients, subject, raw_subject, header_from, raw_header_from, header_to, raw_header_to,
+		header_cc, raw_header_cc, header_reply_to, raw_header_reply_to, body, html_body, raw_data, size, client_ip, client_name, auth_user, smtputf8, helo, mail_params, tls, authenticated,
+		dsn_ret, dsn_envid, is_read, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	result, err := db.conn.Exec(query,
+	result, err := tx.Exec(query,
 		msg.Sender,
 		msg.Recipients,
 		msg.Subject,
+		msg.RawSubject,
+		msg.From,
+		msg.RawFrom,
+		msg.To,
+		msg.RawTo,
+		msg.Cc,
+		msg.RawCc,
+		msg.ReplyTo,
+		msg.RawReplyTo,
 		msg.Body,
+		msg.HTMLBody,
 		msg.RawData,
 		msg.Size,
 		msg.ClientIP,
+		msg.ClientName,
+		msg.AuthUser,
+		msg.SMTPUTF8,
+		msg.Helo,
+		msg.MailParams,
+		msg.TLS,
+		msg.Authenticated,
+		msg.DSNRet,
+		msg.DSNEnvID,
 		msg.IsRead,
 		time.Now(),
 	)
@@ -91,6 +179,61 @@ func (db *DB) SaveMessage(msg *Message) error {
 	if err != nil {
 		return err
 	}
+
+	partQuery := `
+	INSERT INTO message_parts (message_id, path, content_type, charset, filename, content_id, disposition, is_attachment, size, data)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+
+	for i := range msg.Parts {
+		part := &msg.Parts[i]
+		result, err := tx.Exec(partQuery,
+			id,
+			part.Path,
+			part.ContentType,
+			part.Charset,
+			part.Filename,
+			part.ContentID,
+			part.Disposition,
+			part.IsAttachment,
+			len(part.Data),
+			part.Data,
+		)
+		if err != nil {
+			return err
+		}
+		if part.ID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+		part.MessageID = id
+		part.Size = len(part.Data)
+	}
+
+	rcptQuery := `
+	INSERT INTO recipients (message_id, type, address, notify, orcpt)
+	VALUES (?, ?, ?, ?, ?)
+	`
+
+	for _, recipients := range [][]Recipient{msg.EnvelopeRecipients, msg.HeaderRecipients} {
+		for i := range recipients {
+			rcpt := &recipients[i]
+			if rcpt.Type == "" {
+				rcpt.Type = RecipientRcpt
+			}
+			result, err := tx.Exec(rcptQuery, id, rcpt.Type, rcpt.Address, rcpt.Notify, rcpt.ORCPT)
+			if err != nil {
+				return err
+			}
+			if rcpt.ID, err = result.LastInsertId(); err != nil {
+				return err
+			}
+			rcpt.MessageID = id
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 	msg.ID = id
 
 	return nil
@@ -98,7 +241,7 @@ func (db *DB) SaveMessage(msg *Message) error {
 
 func (db *DB) GetMessages() ([]Message, error) {
 	query := `
-	SELECT id, sender, recipients, subject, body, raw_data, size, client_ip, is_read, created_at
+	SELECT ` + messageColumns + `
 	FROM messages
 	ORDER BY created_at DESC
 	`
@@ -109,63 +252,100 @@ func (db *DB) GetMessages() ([]Message, error) {
 	}
 	defer rows.Close()
 
-	var messages []Message
+	return scanMessages(rows)
+}
+
+func (db *DB) GetMessage(id int64) (*Message, error) {
+	query := `
+	SELECT ` + messageColumns + `
+	FROM messages
+	WHERE id = ?
+	`
+
+	return scanMessage(db.conn.QueryRow(query, id))
+}
+
+func (db *DB) GetParts(messageID int64) ([]Part, error) {
+	return db.queryParts(`WHERE message_id = ?`, messageID)
+}
+
+func (db *DB) GetAttachments(messageID int64) ([]Part, error) {
+	return db.queryParts(`WHERE message_id = ? AND is_attachment = 1`, messageID)
+}
+
+func (db *DB) queryParts(where string, args ...interface{}) ([]Part, error) {
+	query := `
+	SELECT id, message_id, path, content_type, charset, filename, content_id, disposition, is_attachment, size, data
+	FROM message_parts
+	` + where + `
+	ORDER BY id
+	`
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var parts []Part
 	for rows.Next() {
-		var msg Message
-		var clientIP sql.NullString
+		var part Part
+		var charset, filename, contentID, disposition sql.NullString
 		err := rows.Scan(
-			&msg.ID,
-			&msg.Sender,
-			&msg.Recipients,
-			&msg.Subject,
-			&msg.Body,
-			&msg.RawData,
-			&msg.Size,
-			&clientIP,
-			&msg.IsRead,
-			&msg.CreatedAt,
+			&part.ID,
+			&part.MessageID,
+			&part.Path,
+			&part.ContentType,
+			&charset,
+			&filename,
+			&contentID,
+			&disposition,
+			&part.IsAttachment,
+			&part.Size,
+			&part.Data,
 		)
 		if err != nil {
 			return nil, err
 		}
-		if clientIP.Valid {
-			msg.ClientIP = clientIP.String
-		}
-		messages = append(messages, msg)
+		part.Charset = charset.String
+		part.Filename = filename.String
+		part.ContentID = contentID.String
+		part.Disposition = disposition.String
+		parts = append(parts, part)
 	}
 
-	return messages, rows.Err()
+	return parts, rows.Err()
 }
 
-func (db *DB) GetMessage(id int64) (*Message, error) {
+// GetRecipients returns the envelope and header recipients of a message in
+// the order they were stored, envelope recipients first.
+func (db *DB) GetRecipients(messageID int64) ([]Recipient, error) {
 	query := `
-	SELECT id, sender, recipients, subject, body, raw_data, size, client_ip, is_read, created_at
-	FROM messages
-	WHERE id = ?
+	SELECT id, message_id, type, address, notify, orcpt
+	FROM recipients
+	WHERE message_id = ?
+	ORDER BY id
 	`
 
-	var msg Message
-	var clientIP sql.NullString
-	err := db.conn.QueryRow(query, id).Scan(
-		&msg.ID,
-		&msg.Sender,
-		&msg.Recipients,
-		&msg.Subject,
-		&msg.Body,
-		&msg.RawData,
-		&msg.Size,
-		&clientIP,
-		&msg.IsRead,
-		&msg.CreatedAt,
-	)
+	rows, err := db.conn.Query(query, messageID)
 	if err != nil {
 		return nil, err
 	}
-	if clientIP.Valid {
-		msg.ClientIP = clientIP.String
+	defer rows.Close()
+
+	var recipients []Recipient
+	for rows.Next() {
+		var rcpt Recipient
+		var notify, orcpt sql.NullString
+		if err := rows.Scan(&rcpt.ID, &rcpt.MessageID, &rcpt.Type, &rcpt.Address, &notify, &orcpt); err != nil {
+			return nil, err
+		}
+		rcpt.Notify = notify.String
+		rcpt.ORCPT = orcpt.String
+		recipients = append(recipients, rcpt)
 	}
 
-	return &msg, nil
+	return recipients, rows.Err()
 }
 
 func (db *DB) MarkAsRead(id int64) error {
@@ -186,6 +366,35 @@ func (db *DB) DeleteAllMessages() error {
 	return err
 }
 
+func (db *DB) DeleteUserMessages(user string) error {
+	query := `DELETE FROM messages WHERE auth_user = ?`
+	_, err := db.conn.Exec(query, user)
+	return err
+}
+
+// GetAuthUsers returns the distinct authenticated users that have sent
+// messages, in alphabetical order.
+func (db *DB) GetAuthUsers() ([]string, error) {
+	query := `SELECT DISTINCT auth_user FROM messages WHERE auth_user IS NOT NULL AND auth_user != '' ORDER BY auth_user`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
 func (db *DB) GetUnreadCount() (int, error) {
 	query := `SELECT COUNT(*) FROM messages WHERE is_read = 0`
 	var count int
@@ -194,44 +403,376 @@ func (db *DB) GetUnreadCount() (int, error) {
 }
 
 func (db *DB) SearchMessages(term string) ([]Message, error) {
+	messages, _, err := db.ListMessages(ListOptions{Search: term})
+	return messages, err
+}
+
+type ListOptions struct {
+	Search string
+	User   string // only messages sent by this authenticated user
+	// Recipient matches messages with this envelope or header recipient,
+	// ignoring case.
+	Recipient string
+	Limit     int // 0 means no limit
+	Offset    int
+}
+
+func (db *DB) ListMessages(opts ListOptions) ([]Message, int, error) {
+	var where []string
+	var args []interface{}
+
+	if opts.Search != "" {
+		searchTerm := "%" + opts.Search + "%"
+		where = append(where, "(sender LIKE ? OR recipients LIKE ? OR subject LIKE ? OR header_from LIKE ? OR header_to LIKE ? OR body LIKE ?)")
+		args = append(args, searchTerm, searchTerm, searchTerm, searchTerm, searchTerm, searchTerm)
+	}
+	if opts.User != "" {
+		where = append(where, "auth_user = ?")
+		args = append(args, opts.User)
+	}
+	if opts.Recipient != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM recipients r WHERE r.message_id = messages.id AND r.address = ? COLLATE NOCASE)")
+		args = append(args, opts.Recipient)
+	}
+
+	whereClause := ""
+	if len(where) > 0 {
+		whereClause = "WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM messages ` + whereClause
+	if err := db.conn.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
 	query := `
-	SELECT id, sender, recipients, subject, body, raw_data, size, client_ip, is_read, created_at
+	SELECT ` + messageColumns + `
 	FROM messages
-	WHERE sender LIKE ? OR recipients LIKE ? OR subject LIKE ? OR body LIKE ?
-	ORDER BY created_at DESC
+	` + whereClause + `
+	ORDER BY created_at DESC, id DESC
 	`
+	if opts.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, opts.Limit, opts.Offset)
+	}
 
-	searchTerm := "%" + term + "%"
-	rows, err := db.conn.Query(query, searchTerm, searchTerm, searchTerm, searchTerm)
+	rows, err := db.conn.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return messages, total, nil
+}
+
+const messageColumns = `id, sender, recipients, subject, raw_subject, header_from, raw_header_from, header_to, raw_header_to,
+	header_cc, raw_header_cc, header_reply_to, raw_header_reply_to, body, html_body, raw_data, size, client_ip, client_name, auth_user, smtputf8, helo, mail_params, tls, authenticated, dsn_ret, dsn_envid, is_read, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (*Message, error) {
+	var msg Message
+	var clientIP, clientName, htmlBody, authUser, helo, mailParams, dsnRet, dsnEnvID sql.NullString
+	var headers [9]sql.NullString
+	err := row.Scan(
+		&msg.ID,
+		&msg.Sender,
+		&msg.Recipients,
+		&msg.Subject,
+		&headers[0],
+		&headers[1],
+		&headers[2],
+		&headers[3],
+		&headers[4],
+		&headers[5],
+		&headers[6],
+		&headers[7],
+		&headers[8],
+		&msg.Body,
+		&htmlBody,
+		&msg.RawData,
+		&msg.Size,
+		&clientIP,
+		&clientName,
+		&authUser,
+		&msg.SMTPUTF8,
+		&helo,
+		&mailParams,
+		&msg.TLS,
+		&msg.Authenticated,
+		&dsnRet,
+		&dsnEnvID,
+		&msg.IsRead,
+		&msg.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if clientIP.Valid {
+		msg.ClientIP = clientIP.String
+	}
+	msg.ClientName = clientName.String
+	msg.HTMLBody = htmlBody.String
+	msg.AuthUser = authUser.String
+	msg.Helo = helo.String
+	msg.MailParams = mailParams.String
+	msg.DSNRet = dsnRet.String
+	msg.DSNEnvID = dsnEnvID.String
+	msg.RawSubject = headers[0].String
+	msg.From, msg.RawFrom = headers[1].String, headers[2].String
+	msg.To, msg.RawTo = headers[3].String, headers[4].String
+	msg.Cc, msg.RawCc = headers[5].String, headers[6].String
+	msg.ReplyTo, msg.RawReplyTo = headers[7].String, headers[8].String
+
+	return &msg, nil
+}
+
+func scanMessages(rows *sql.Rows) ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
-		var msg Message
-		var clientIP sql.NullString
-		err := rows.Scan(
-			&msg.ID,
-			&msg.Sender,
-			&msg.Recipients,
-			&msg.Subject,
-			&msg.Body,
-			&msg.RawData,
-			&msg.Size,
-			&clientIP,
-			&msg.IsRead,
-			&msg.CreatedAt,
-		)
+		msg, err := scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		if clientIP.Valid {
-			msg.ClientIP = clientIP.String
-		}
-		messages = append(messages, msg)
+		messages = append(messages, *msg)
 	}
 
 	return messages, rows.Err()
 }
+
+// GreylistEntry tracks delivery attempts for one (client IP, sender,
+// recipient) triplet.
+type GreylistEntry struct {
+	ClientIP  string
+	Sender    string
+	Recipient string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	PassedAt  time.Time // zero while the triplet is still greylisted
+	Attempts  int
+}
+
+func (e *GreylistEntry) Passed() bool {
+	return !e.PassedAt.IsZero()
+}
+
+// RecordGreylistAttempt records a delivery attempt for a triplet and returns
+// its updated state. A triplet passes once an attempt arrives at least delay
+// after it was first seen; pending triplets not retried within expire start
+// over.
+func (db *DB) RecordGreylistAttempt(clientIP, sender, recipient string, now time.Time, delay, expire time.Duration) (*GreylistEntry, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	entry := GreylistEntry{ClientIP: clientIP, Sender: sender, Recipient: recipient}
+	var passedAt sql.NullTime
+	err = tx.QueryRow(`
+	SELECT first_seen, last_seen, passed_at, attempts
+	FROM greylist
+	WHERE client_ip = ? AND sender = ? AND recipient = ?
+	`, clientIP, sender, recipient).Scan(&entry.FirstSeen, &entry.LastSeen, &passedAt, &entry.Attempts)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	entry.PassedAt = passedAt.Time
+
+	if !found || (!entry.Passed() && expire > 0 && now.Sub(entry.FirstSeen) > expire) {
+		entry.FirstSeen, entry.PassedAt, entry.Attempts = now, time.Time{}, 0
+	} else if !entry.Passed() && now.Sub(entry.FirstSeen) >= delay {
+		entry.PassedAt = now
+	}
+	entry.LastSeen = now
+	entry.Attempts++
+
+	passedAt = sql.NullTime{Time: entry.PassedAt, Valid: entry.Passed()}
+	_, err = tx.Exec(`
+	INSERT INTO greylist (client_ip, sender, recipient, first_seen, last_seen, passed_at, attempts)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (client_ip, sender, recipient) DO UPDATE SET
+		first_seen = excluded.first_seen,
+		last_seen = excluded.last_seen,
+		passed_at = excluded.passed_at,
+		attempts = excluded.attempts
+	`, clientIP, sender, recipient, entry.FirstSeen, entry.LastSeen, passedAt, entry.Attempts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ListGreylist returns greylist triplets, most recently seen first. With
+// pendingOnly, triplets that have passed are left out.
+func (db *DB) ListGreylist(pendingOnly bool) ([]GreylistEntry, error) {
+	query := `
+	SELECT client_ip, sender, recipient, first_seen, last_seen, passed_at, attempts
+	FROM greylist
+	`
+	if pendingOnly {
+		query += `WHERE passed_at IS NULL
+	`
+	}
+	query += `ORDER BY last_seen DESC`
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []GreylistEntry
+	for rows.Next() {
+		var entry GreylistEntry
+		var passedAt sql.NullTime
+		err := rows.Scan(&entry.ClientIP, &entry.Sender, &entry.Recipient, &entry.FirstSeen, &entry.LastSeen, &passedAt, &entry.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		entry.PassedAt = passedAt.Time
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (db *DB) ClearGreylist() error {
+	_, err := db.conn.Exec(`DELETE FROM greylist`)
+	return err
+}
+
+// RetentionPolicy limits which messages are kept. Zero fields are no limit.
+type RetentionPolicy struct {
+	MaxMessages int
+	MaxAge      time.Duration
+	MaxSize     int // total raw size of the kept messages in bytes
+}
+
+// PruneResult describes the messages removed by Prune.
+type PruneResult struct {
+	Messages int
+	Size     int // raw size of the removed messages in bytes
+}
+
+// Prune deletes the messages that fall outside policy: those older than
+// MaxAge, and, from the first message that would exceed MaxMessages or
+// MaxSize counting from the newest, that message and every older one.
+func (db *DB) Prune(policy RetentionPolicy, now time.Time) (PruneResult, error) {
+	var result PruneResult
+
+	rows, err := db.conn.Query(`SELECT id, size, created_at FROM messages ORDER BY id DESC`)
+	if err != nil {
+		return result, err
+	}
+
+	var expired []int64
+	kept, keptSize := 0, 0
+	full := false // once a limit is reached, every older message goes too
+	for rows.Next() {
+		var id int64
+		var size int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &size, &createdAt); err != nil {
+			rows.Close()
+			return result, err
+		}
+
+		if (policy.MaxMessages > 0 && kept >= policy.MaxMessages) ||
+			(policy.MaxSize > 0 && keptSize+size > policy.MaxSize) {
+			full = true
+		}
+		if full || (policy.MaxAge > 0 && now.Sub(createdAt) > policy.MaxAge) {
+			expired = append(expired, id)
+			result.Size += size
+			continue
+		}
+		kept++
+		keptSize += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	if len(expired) == 0 {
+		return result, nil
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`DELETE FROM messages WHERE id = ?`)
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+	for _, id := range expired {
+		if _, err := stmt.Exec(id); err != nil {
+			return result, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, err
+	}
+	result.Messages = len(expired)
+	return result, nil
+}
+
+// IncrementalVacuum returns the free pages of the database file to the file
+// system and reports how many bytes were released. A database created
+// before incremental auto-vacuum was enabled is converted with a full
+// VACUUM first.
+func (db *DB) IncrementalVacuum() (int, error) {
+	var mode, pageSize, before, after int
+	if err := db.conn.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return 0, err
+	}
+	if err := db.conn.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	if err := db.conn.QueryRow(`PRAGMA freelist_count`).Scan(&before); err != nil {
+		return 0, err
+	}
+
+	if mode != 2 { // INCREMENTAL
+		// Every connection sets auto_vacuum (see dsn), so VACUUM applies it
+		if _, err := db.conn.Exec(`VACUUM`); err != nil {
+			return 0, err
+		}
+	} else {
+		// The driver only steps Exec once, which frees a single page; read
+		// the pragma to the end to free them all.
+		rows, err := db.conn.Query(`PRAGMA incremental_vacuum`)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := db.conn.QueryRow(`PRAGMA freelist_count`).Scan(&after); err != nil {
+		return 0, err
+	}
+	return (before - after) * pageSize, nil
+}
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"database/sql"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -103,6 +106,7 @@ func TestGetMessage(t *testing.T) {
 		RawData:    []byte("raw data"),
 		Size:       100,
 		ClientIP:   "192.168.1.1",
+		ClientName: "client.example.com",
 		IsRead:     false,
 	}
 
@@ -133,6 +137,58 @@ func TestGetMessage(t *testing.T) {
 	if retrieved.ClientIP != original.ClientIP {
 		t.Errorf("expected client IP %q, got %q", original.ClientIP, retrieved.ClientIP)
 	}
+	if retrieved.ClientName != original.ClientName {
+		t.Errorf("expected client name %q, got %q", original.ClientName, retrieved.ClientName)
+	}
+}
+
+func TestDecodedHeadersRoundTrip(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	original := &Message{
+		Sender:     "sender@example.com",
+		Recipients: "recipient@example.com",
+		Subject:    "Grüße",
+		RawSubject: "=?UTF-8?Q?Gr=C3=BC=C3=9Fe?=",
+		From:       "Renée <renee@example.com>",
+		RawFrom:    "=?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>",
+		To:         "recipient@example.com",
+		RawTo:      "recipient@example.com",
+		ReplyTo:    "Support <support@example.com>",
+		RawReplyTo: "=?UTF-8?B?U3VwcG9ydA==?= <support@example.com>",
+		RawData:    []byte("raw data"),
+	}
+
+	if err := db.SaveMessage(original); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	retrieved, err := db.GetMessage(original.ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+
+	if retrieved.Subject != original.Subject || retrieved.RawSubject != original.RawSubject {
+		t.Errorf("unexpected subject: %q / %q", retrieved.Subject, retrieved.RawSubject)
+	}
+	if retrieved.From != original.From || retrieved.RawFrom != original.RawFrom {
+		t.Errorf("unexpected from: %q / %q", retrieved.From, retrieved.RawFrom)
+	}
+	if retrieved.ReplyTo != original.ReplyTo || retrieved.RawReplyTo != original.RawReplyTo {
+		t.Errorf("unexpected reply-to: %q / %q", retrieved.ReplyTo, retrieved.RawReplyTo)
+	}
+	if retrieved.Cc != "" || retrieved.RawCc != "" {
+		t.Errorf("expected empty cc, got %q / %q", retrieved.Cc, retrieved.RawCc)
+	}
+
+	results, err := db.SearchMessages("Renée")
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected search on decoded From to match, got %d results", len(results))
+	}
 }
 
 func TestMarkAsRead(t *testing.T) {
@@ -340,3 +396,510 @@ func TestMessagesOrderedByCreatedAt(t *testing.T) {
 		t.Errorf("expected last message to be 'First', got %q", messages[2].Subject)
 	}
 }
+
+func TestListMessagesPagination(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		msg := &Message{
+			Sender:     "sender@example.com",
+			Recipients: "recipient@example.com",
+			Subject:    fmt.Sprintf("Message %d", i),
+			Body:       "Body",
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	page, total, err := db.ListMessages(ListOptions{Limit: 2, Offset: 1})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+
+	if total != 5 {
+		t.Errorf("expected total 5, got %d", total)
+	}
+	if len(page) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(page))
+	}
+	if page[0].Subject != "Message 3" {
+		t.Errorf("expected first message on page to be 'Message 3', got %q", page[0].Subject)
+	}
+	if page[1].Subject != "Message 2" {
+		t.Errorf("expected second message on page to be 'Message 2', got %q", page[1].Subject)
+	}
+}
+
+func TestListMessagesSearch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	messages := []*Message{
+		{Sender: "alice@example.com", Recipients: "bob@example.com", Subject: "Invoice", Body: "Body"},
+		{Sender: "alice@example.com", Recipients: "bob@example.com", Subject: "Invoice reminder", Body: "Body"},
+		{Sender: "carol@example.com", Recipients: "bob@example.com", Subject: "Lunch", Body: "Body"},
+	}
+	for _, msg := range messages {
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	results, total, err := db.ListMessages(ListOptions{Search: "Invoice", Limit: 1})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+
+	if total != 2 {
+		t.Errorf("expected total 2, got %d", total)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected 1 result, got %d", len(results))
+	}
+}
+
+func TestListMessagesByUser(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, user := range []string{"team-b", "team-a", "", "team-a"} {
+		msg := &Message{
+			Sender:     "sender@example.com",
+			Recipients: "recipient@example.com",
+			Subject:    "From " + user,
+			AuthUser:   user,
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	messages, total, err := db.ListMessages(ListOptions{User: "team-a"})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+	if total != 2 || len(messages) != 2 {
+		t.Fatalf("expected 2 messages for team-a, got %d (total %d)", len(messages), total)
+	}
+	for _, msg := range messages {
+		if msg.AuthUser != "team-a" {
+			t.Errorf("expected auth user team-a, got %q", msg.AuthUser)
+		}
+	}
+
+	users, err := db.GetAuthUsers()
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+	if len(users) != 2 || users[0] != "team-a" || users[1] != "team-b" {
+		t.Errorf("expected [team-a team-b], got %v", users)
+	}
+
+	if err := db.DeleteUserMessages("team-a"); err != nil {
+		t.Fatalf("failed to delete user messages: %v", err)
+	}
+	all, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("expected 2 messages to remain, got %d", len(all))
+	}
+}
+
+func TestSaveMessageWithParts(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := &Message{
+		Sender:     "sender@example.com",
+		Recipients: "recipient@example.com",
+		Subject:    "Invoice",
+		Body:       "See attached.",
+		HTMLBody:   "<p>See attached.</p>",
+		Parts: []Part{
+			{Path: "1.1", ContentType: "text/plain", Charset: "utf-8", Data: []byte("See attached.")},
+			{Path: "1.2", ContentType: "text/html", Charset: "utf-8", Data: []byte("<p>See attached.</p>")},
+			{Path: "2", ContentType: "application/pdf", Filename: "invoice.pdf", Disposition: "attachment", IsAttachment: true, Data: []byte("%PDF-1.4")},
+		},
+	}
+
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	retrieved, err := db.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if retrieved.HTMLBody != msg.HTMLBody {
+		t.Errorf("expected HTML body %q, got %q", msg.HTMLBody, retrieved.HTMLBody)
+	}
+
+	parts, err := db.GetParts(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get parts: %v", err)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	if parts[1].Path != "1.2" || parts[1].ContentType != "text/html" {
+		t.Errorf("unexpected second part: %+v", parts[1])
+	}
+
+	attachments, err := db.GetAttachments(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get attachments: %v", err)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(attachments))
+	}
+	if attachments[0].Filename != "invoice.pdf" {
+		t.Errorf("expected filename 'invoice.pdf', got %q", attachments[0].Filename)
+	}
+	if attachments[0].Size != len("%PDF-1.4") {
+		t.Errorf("expected size %d, got %d", len("%PDF-1.4"), attachments[0].Size)
+	}
+	if string(attachments[0].Data) != "%PDF-1.4" {
+		t.Errorf("unexpected attachment data: %q", attachments[0].Data)
+	}
+}
+
+func TestDeleteMessageRemovesParts(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := &Message{
+		Sender:     "sender@example.com",
+		Recipients: "recipient@example.com",
+		Parts: []Part{
+			{Path: "1", ContentType: "image/png", IsAttachment: true, Data: []byte("png")},
+		},
+	}
+
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	if err := db.DeleteMessage(msg.ID); err != nil {
+		t.Fatalf("failed to delete message: %v", err)
+	}
+
+	parts, err := db.GetParts(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get parts: %v", err)
+	}
+	if len(parts) != 0 {
+		t.Errorf("expected parts to be deleted with message, got %d", len(parts))
+	}
+}
+
+func TestSaveMessageWithRecipients(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	msg := &Message{
+		Sender:     "sender@example.com",
+		Recipients: "a@example.com, b@example.com",
+		DSNRet:     "HDRS",
+		DSNEnvID:   "QQ314159",
+		EnvelopeRecipients: []Recipient{
+			{Address: "a@example.com", Notify: "SUCCESS,FAILURE", ORCPT: "rfc822;a@example.com"},
+			{Address: "b@example.com"},
+		},
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message: %v", err)
+	}
+
+	retrieved, err := db.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if retrieved.DSNRet != "HDRS" || retrieved.DSNEnvID != "QQ314159" {
+		t.Errorf("unexpected DSN parameters: ret %q envid %q", retrieved.DSNRet, retrieved.DSNEnvID)
+	}
+
+	recipients, err := db.GetRecipients(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get recipients: %v", err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(recipients))
+	}
+	if recipients[0].Notify != "SUCCESS,FAILURE" || recipients[0].ORCPT != "rfc822;a@example.com" {
+		t.Errorf("unexpected first recipient: %+v", recipients[0])
+	}
+	if recipients[1].Address != "b@example.com" || recipients[1].Notify != "" {
+		t.Errorf("unexpected second recipient: %+v", recipients[1])
+	}
+
+	if err := db.DeleteMessage(msg.ID); err != nil {
+		t.Fatalf("failed to delete message: %v", err)
+	}
+	recipients, err = db.GetRecipients(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get recipients: %v", err)
+	}
+	if len(recipients) != 0 {
+		t.Errorf("expected recipients to be deleted with message, got %d", len(recipients))
+	}
+}
+
+func TestListMessagesByRecipient(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	messages := []*Message{
+		{
+			Sender:             "sender@example.com",
+			Recipients:         "bob@example.com",
+			Subject:            "Envelope",
+			Helo:               "client.example.com",
+			MailParams:         "BODY=8BITMIME",
+			TLS:                true,
+			Authenticated:      true,
+			EnvelopeRecipients: []Recipient{{Address: "bob@example.com"}},
+			HeaderRecipients:   []Recipient{{Type: RecipientTo, Address: "list@example.com"}},
+		},
+		{
+			Sender:             "sender@example.com",
+			Recipients:         "carol@example.com",
+			Subject:            "Cc",
+			EnvelopeRecipients: []Recipient{{Address: "carol@example.com"}},
+			HeaderRecipients:   []Recipient{{Type: RecipientCc, Address: "Bob@Example.com"}},
+		},
+		{
+			Sender:             "sender@example.com",
+			Recipients:         "dave@example.com",
+			Subject:            "Other",
+			EnvelopeRecipients: []Recipient{{Address: "dave@example.com"}},
+		},
+	}
+	for _, msg := range messages {
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+
+	results, total, err := db.ListMessages(ListOptions{Recipient: "bob@example.com"})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+	if total != 2 || len(results) != 2 {
+		t.Fatalf("expected 2 messages for bob, got %d", total)
+	}
+
+	first, err := db.GetMessage(messages[0].ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if first.Helo != "client.example.com" || first.MailParams != "BODY=8BITMIME" || !first.TLS || !first.Authenticated {
+		t.Errorf("unexpected transaction details: %+v", first)
+	}
+
+	recipients, err := db.GetRecipients(messages[0].ID)
+	if err != nil {
+		t.Fatalf("failed to get recipients: %v", err)
+	}
+	if len(recipients) != 2 || recipients[0].Type != RecipientRcpt || recipients[1].Type != RecipientTo {
+		t.Errorf("unexpected recipients: %+v", recipients)
+	}
+}
+
+func TestRecordGreylistAttempt(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	start := time.Now()
+	attempt := func(after time.Duration) *GreylistEntry {
+		t.Helper()
+		entry, err := db.RecordGreylistAttempt("127.0.0.1", "sender@example.com", "rcpt@example.com", start.Add(after), time.Minute, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to record attempt: %v", err)
+		}
+		return entry
+	}
+
+	if entry := attempt(0); entry.Passed() || entry.Attempts != 1 {
+		t.Errorf("expected the first attempt to be greylisted, got %+v", entry)
+	}
+	if entry := attempt(30 * time.Second); entry.Passed() || entry.Attempts != 2 {
+		t.Errorf("expected an early retry to be greylisted, got %+v", entry)
+	}
+	if entry := attempt(2 * time.Minute); !entry.Passed() || entry.Attempts != 3 {
+		t.Errorf("expected a retry after the delay to pass, got %+v", entry)
+	}
+	if entry := attempt(3 * time.Hour); !entry.Passed() {
+		t.Errorf("expected a passed triplet to stay passed, got %+v", entry)
+	}
+
+	// A pending triplet that is not retried within expire starts over
+	if _, err := db.RecordGreylistAttempt("127.0.0.1", "sender@example.com", "late@example.com", start, time.Minute, time.Hour); err != nil {
+		t.Fatalf("failed to record attempt: %v", err)
+	}
+	entry, err := db.RecordGreylistAttempt("127.0.0.1", "sender@example.com", "late@example.com", start.Add(2*time.Hour), time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to record attempt: %v", err)
+	}
+	if entry.Passed() || entry.Attempts != 1 || !entry.FirstSeen.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("expected an expired triplet to start over, got %+v", entry)
+	}
+
+	pending, err := db.ListGreylist(true)
+	if err != nil {
+		t.Fatalf("failed to list greylist: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Recipient != "late@example.com" {
+		t.Errorf("expected only late@example.com to be pending, got %+v", pending)
+	}
+
+	if err := db.ClearGreylist(); err != nil {
+		t.Fatalf("failed to clear greylist: %v", err)
+	}
+	all, err := db.ListGreylist(false)
+	if err != nil {
+		t.Fatalf("failed to list greylist: %v", err)
+	}
+	if len(all) != 0 {
+		t.Errorf("expected an empty greylist, got %d entries", len(all))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		sizes  []int // oldest first, 100 bytes each if nil
+		policy RetentionPolicy
+		now    time.Time
+		kept   []string
+	}{
+		{"no limits", nil, RetentionPolicy{}, now, []string{"5", "4", "3", "2", "1"}},
+		{"max messages", nil, RetentionPolicy{MaxMessages: 3}, now, []string{"5", "4", "3"}},
+		{"max size", nil, RetentionPolicy{MaxSize: 250}, now, []string{"5", "4"}},
+		{"max age", nil, RetentionPolicy{MaxAge: time.Hour}, now.Add(2 * time.Hour), nil},
+		{"combined", nil, RetentionPolicy{MaxMessages: 4, MaxSize: 1000, MaxAge: time.Hour}, now, []string{"5", "4", "3", "2"}},
+		// Older messages go once a newer one does not fit, even if they would
+		{"max size newest too large", []int{100, 100, 500}, RetentionPolicy{MaxSize: 300}, now, nil},
+		{"max size oldest first", []int{100, 500, 100, 100, 100}, RetentionPolicy{MaxSize: 400}, now, []string{"5", "4", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := setupTestDB(t)
+			defer cleanup()
+
+			sizes := tt.sizes
+			if sizes == nil {
+				sizes = []int{100, 100, 100, 100, 100}
+			}
+			total := 0
+			for i, size := range sizes {
+				msg := &Message{Sender: "sender@example.com", Recipients: "rcpt@example.com", Subject: fmt.Sprint(i + 1), Size: size}
+				if err := db.SaveMessage(msg); err != nil {
+					t.Fatalf("failed to save message: %v", err)
+				}
+				total += size
+			}
+			keptSize := 0
+			for _, subject := range tt.kept {
+				var i int
+				fmt.Sscan(subject, &i)
+				keptSize += sizes[i-1]
+			}
+
+			result, err := db.Prune(tt.policy, tt.now)
+			if err != nil {
+				t.Fatalf("failed to prune: %v", err)
+			}
+			if result.Messages != len(sizes)-len(tt.kept) || result.Size != total-keptSize {
+				t.Errorf("unexpected result %+v", result)
+			}
+
+			messages, err := db.GetMessages()
+			if err != nil {
+				t.Fatalf("failed to get messages: %v", err)
+			}
+			var kept []string
+			for _, msg := range messages {
+				kept = append(kept, msg.Subject)
+			}
+			if fmt.Sprint(kept) != fmt.Sprint(tt.kept) {
+				t.Errorf("expected to keep %v, got %v", tt.kept, kept)
+			}
+		})
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var mode int
+	if err := db.conn.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		t.Fatalf("failed to read auto_vacuum: %v", err)
+	}
+	if mode != 2 {
+		t.Errorf("expected a new database to use incremental auto-vacuum, got mode %d", mode)
+	}
+
+	for i := 0; i < 5; i++ {
+		msg := &Message{Sender: "sender@example.com", Recipients: "rcpt@example.com", RawData: make([]byte, 100000), Size: 100000}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+	if err := db.DeleteAllMessages(); err != nil {
+		t.Fatalf("failed to delete messages: %v", err)
+	}
+
+	reclaimed, err := db.IncrementalVacuum()
+	if err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+	if reclaimed < 400000 {
+		t.Errorf("expected the deleted messages' space to be reclaimed, got %d bytes", reclaimed)
+	}
+
+	var free int
+	if err := db.conn.QueryRow(`PRAGMA freelist_count`).Scan(&free); err != nil {
+		t.Fatalf("failed to read freelist_count: %v", err)
+	}
+	if free != 0 {
+		t.Errorf("expected no free pages after vacuum, got %d", free)
+	}
+}
+
+func TestIncrementalVacuumConvertsDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// A database created before auto-vacuum was enabled
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if _, err := old.Exec(`CREATE TABLE legacy (id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	old.Close()
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.IncrementalVacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+	var mode int
+	if err := db.conn.QueryRow(`PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		t.Fatalf("failed to read auto_vacuum: %v", err)
+	}
+	if mode != 2 {
+		t.Errorf("expected the database to be converted to incremental auto-vacuum, got mode %d", mode)
+	}
+}
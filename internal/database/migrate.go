@@ -0,0 +1,329 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrSchemaTooNew = errors.New("database was written by a newer version of devsmtp")
+
+// migration is one step of the schema history. Released steps must never
+// change; fix mistakes with a new step.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+// migrations is the schema history, oldest first. Databases created before
+// schema versioning start at version 0 but may already have some of these
+// changes, so every step must be safe to apply again.
+var migrations = []migration{
+	{1, "Create messages table", func(tx *sql.Tx) error {
+		return execAll(tx, `
+		CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			sender TEXT NOT NULL,
+			recipients TEXT NOT NULL,
+			subject TEXT,
+			body TEXT,
+			raw_data BLOB,
+			size INTEGER NOT NULL DEFAULT 0,
+			client_ip TEXT,
+			is_read BOOLEAN NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_messages_is_read ON messages(is_read)`,
+		)
+	}},
+	{2, "Store decoded MIME parts", func(tx *sql.Tx) error {
+		if err := addColumns(tx, "messages", "html_body TEXT"); err != nil {
+			return err
+		}
+		return execAll(tx, `
+		CREATE TABLE IF NOT EXISTS message_parts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			path TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			charset TEXT,
+			filename TEXT,
+			content_id TEXT,
+			disposition TEXT,
+			is_attachment BOOLEAN NOT NULL DEFAULT 0,
+			size INTEGER NOT NULL DEFAULT 0,
+			data BLOB
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_message_parts_message_id ON message_parts(message_id)`,
+		)
+	}},
+	{3, "Store decoded and raw headers", func(tx *sql.Tx) error {
+		return addColumns(tx, "messages",
+			"raw_subject TEXT",
+			"header_from TEXT",
+			"raw_header_from TEXT",
+			"header_to TEXT",
+			"raw_header_to TEXT",
+			"header_cc TEXT",
+			"raw_header_cc TEXT",
+			"header_reply_to TEXT",
+			"raw_header_reply_to TEXT",
+		)
+	}},
+	{4, "Record the SMTP AUTH user", func(tx *sql.Tx) error {
+		if err := addColumns(tx, "messages", "auth_user TEXT"); err != nil {
+			return err
+		}
+		return execAll(tx, `CREATE INDEX IF NOT EXISTS idx_messages_auth_user ON messages(auth_user)`)
+	}},
+	{5, "Record SMTPUTF8", func(tx *sql.Tx) error {
+		return addColumns(tx, "messages", "smtputf8 BOOLEAN NOT NULL DEFAULT 0")
+	}},
+	{6, "Store DSN parameters and recipients", func(tx *sql.Tx) error {
+		if err := addColumns(tx, "messages", "dsn_ret TEXT", "dsn_envid TEXT"); err != nil {
+			return err
+		}
+		return execAll(tx, `
+		CREATE TABLE IF NOT EXISTS recipients (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			address TEXT NOT NULL,
+			notify TEXT,
+			orcpt TEXT
+		)`,
+			`CREATE INDEX IF NOT EXISTS idx_recipients_message_id ON recipients(message_id)`,
+		)
+	}},
+	{7, "Store transaction details and header recipients", func(tx *sql.Tx) error {
+		err := addColumns(tx, "messages",
+			"helo TEXT",
+			"mail_params TEXT",
+			"tls BOOLEAN NOT NULL DEFAULT 0",
+			"authenticated BOOLEAN NOT NULL DEFAULT 0",
+		)
+		if err != nil {
+			return err
+		}
+		if err := addColumns(tx, "recipients", "type TEXT NOT NULL DEFAULT 'rcpt'"); err != nil {
+			return err
+		}
+		return execAll(tx, `CREATE INDEX IF NOT EXISTS idx_recipients_address ON recipients(address COLLATE NOCASE)`)
+	}},
+	{8, "Create greylist table", func(tx *sql.Tx) error {
+		return execAll(tx, `
+		CREATE TABLE IF NOT EXISTS greylist (
+			client_ip TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			passed_at DATETIME,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (client_ip, sender, recipient)
+		)`)
+	}},
+	{9, "Record the client hostname", func(tx *sql.Tx) error {
+		return addColumns(tx, "messages", "client_name TEXT")
+	}},
+}
+
+// SchemaMigration is a migration known to this build or recorded in the
+// database.
+type SchemaMigration struct {
+	Version     int
+	Description string
+	AppliedAt   time.Time // zero while pending
+}
+
+func (m SchemaMigration) Applied() bool {
+	return !m.AppliedAt.IsZero()
+}
+
+// LatestSchemaVersion returns the schema version this build migrates to.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, 0 for a new or unversioned database.
+func (db *DB) SchemaVersion() (int, error) {
+	exists, err := db.hasSchemaVersionTable()
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = db.conn.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// Migrations returns every migration known to this build or applied to the
+// database, oldest first. Migrations applied by a newer version of DevSmtp
+// are included with their recorded description.
+func (db *DB) Migrations() ([]SchemaMigration, error) {
+	applied := make(map[int]SchemaMigration)
+	exists, err := db.hasSchemaVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		rows, err := db.conn.Query(`SELECT version, description, applied_at FROM schema_version`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var m SchemaMigration
+			if err := rows.Scan(&m.Version, &m.Description, &m.AppliedAt); err != nil {
+				return nil, err
+			}
+			applied[m.Version] = m
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []SchemaMigration
+	for _, m := range migrations {
+		if a, ok := applied[m.version]; ok {
+			result = append(result, a)
+			delete(applied, m.version)
+			continue
+		}
+		result = append(result, SchemaMigration{Version: m.version, Description: m.description})
+	}
+	for version := LatestSchemaVersion() + 1; len(applied) > 0; version++ {
+		if a, ok := applied[version]; ok {
+			result = append(result, a)
+			delete(applied, version)
+		}
+	}
+	return result, nil
+}
+
+// Migrate applies the pending migrations in order, each in its own
+// transaction, and returns the ones it applied. It refuses to touch a
+// database whose schema is newer than this build knows.
+func (db *DB) Migrate() ([]SchemaMigration, error) {
+	current, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return nil, fmt.Errorf("%w: schema version %d, this version supports up to %d", ErrSchemaTooNew, current, latest)
+	}
+
+	var applied []SchemaMigration
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		result, ok, err := db.apply(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s) failed: %w", m.version, m.description, err)
+		}
+		if ok {
+			applied = append(applied, result)
+		}
+	}
+	return applied, nil
+}
+
+// apply runs one migration and records it. It reports false if another
+// process applied it first.
+func (db *DB) apply(m migration) (SchemaMigration, bool, error) {
+	result := SchemaMigration{Version: m.version, Description: m.description}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return result, false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`)
+	if err != nil {
+		return result, false, err
+	}
+
+	var done bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_version WHERE version = ?)`, m.version).Scan(&done); err != nil {
+		return result, false, err
+	}
+	if done {
+		return result, false, nil
+	}
+
+	if err := m.up(tx); err != nil {
+		return result, false, err
+	}
+
+	result.AppliedAt = time.Now()
+	_, err = tx.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.description, result.AppliedAt)
+	if err != nil {
+		return result, false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return result, false, err
+	}
+	return result, true, nil
+}
+
+func (db *DB) hasSchemaVersionTable() (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'schema_version')`).Scan(&exists)
+	return exists, err
+}
+
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumns adds the columns given as "name definition" to table, skipping
+// those it already has.
+func addColumns(tx *sql.Tx, table string, columns ...string) error {
+	rows, err := tx.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[strings.ToLower(name)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		name, _, _ := strings.Cut(column, " ")
+		if existing[strings.ToLower(name)] {
+			continue
+		}
+		if _, err := tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrationsOrdered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d, expected %d", i, m.version, i+1)
+		}
+		if m.description == "" {
+			t.Errorf("migration %d has no description", m.version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	status, err := db.Migrations()
+	if err != nil {
+		t.Fatalf("failed to get migrations: %v", err)
+	}
+	if len(status) != len(migrations) || status[0].Applied() {
+		t.Fatalf("expected %d pending migrations, got %+v", len(migrations), status)
+	}
+
+	applied, err := db.Migrate()
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("expected %d migrations to be applied, got %d", len(migrations), len(applied))
+	}
+	if version, _ := db.SchemaVersion(); version != LatestSchemaVersion() {
+		t.Errorf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+
+	status, err = db.Migrations()
+	if err != nil {
+		t.Fatalf("failed to get migrations: %v", err)
+	}
+	for _, m := range status {
+		if !m.Applied() {
+			t.Errorf("expected migration %d to be applied", m.Version)
+		}
+	}
+
+	if applied, err := db.Migrate(); err != nil || len(applied) != 0 {
+		t.Errorf("expected nothing to migrate, got %d migrations and error %v", len(applied), err)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+
+	// The schema of the first release, with a captured message
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	_, err = old.Exec(`
+	CREATE TABLE messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		subject TEXT,
+		body TEXT,
+		raw_data BLOB,
+		size INTEGER NOT NULL DEFAULT 0,
+		client_ip TEXT,
+		is_read BOOLEAN NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO messages (sender, recipients, subject, body, raw_data, size, client_ip)
+	VALUES ('old@example.com', 'rcpt@example.com', 'Old', 'Old body', 'Subject: Old', 12, '127.0.0.1');
+	`)
+	if err != nil {
+		t.Fatalf("failed to create old schema: %v", err)
+	}
+	old.Close()
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to open old database: %v", err)
+	}
+	defer db.Close()
+
+	if version, _ := db.SchemaVersion(); version != LatestSchemaVersion() {
+		t.Errorf("expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to read old messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Subject != "Old" || messages[0].AuthUser != "" || messages[0].TLS {
+		t.Errorf("unexpected old messages: %+v", messages)
+	}
+
+	msg := &Message{
+		Sender:             "new@example.com",
+		Recipients:         "rcpt@example.com",
+		AuthUser:           "team-a",
+		ClientName:         "client.example.com",
+		TLS:                true,
+		EnvelopeRecipients: []Recipient{{Address: "rcpt@example.com", Notify: "NEVER"}},
+		Parts:              []Part{{Path: "1", ContentType: "text/plain"}},
+	}
+	if err := db.SaveMessage(msg); err != nil {
+		t.Fatalf("failed to save message in migrated database: %v", err)
+	}
+	got, err := db.GetMessage(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if got.AuthUser != "team-a" || got.ClientName != "client.example.com" || !got.TLS {
+		t.Errorf("unexpected message %+v", got)
+	}
+
+	// Unversioned databases may already have later columns, so every step
+	// must apply cleanly again
+	if _, err := db.conn.Exec(`DROP TABLE schema_version`); err != nil {
+		t.Fatalf("failed to drop schema_version: %v", err)
+	}
+	if applied, err := db.Migrate(); err != nil || len(applied) != len(migrations) {
+		t.Errorf("expected every migration to be reapplied, got %d and error %v", len(applied), err)
+	}
+}
+
+func TestNewRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	next := LatestSchemaVersion() + 1
+	_, err = db.conn.Exec(`INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)`,
+		next, "From the future", time.Now())
+	if err != nil {
+		t.Fatalf("failed to record migration: %v", err)
+	}
+	db.Close()
+
+	if _, err := New(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	status, err := db.Migrations()
+	if err != nil {
+		t.Fatalf("failed to get migrations: %v", err)
+	}
+	last := status[len(status)-1]
+	if last.Version != next || last.Description != "From the future" || !last.Applied() {
+		t.Errorf("expected the newer migration to be listed, got %+v", last)
+	}
+}
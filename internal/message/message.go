@@ -0,0 +1,268 @@
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// maxDepth bounds multipart nesting so a hostile message cannot recurse
+// forever.
+const maxDepth = 20
+
+type Message struct {
+	Header mail.Header
+
+	// Header values with RFC 2047 encoded words decoded; the Raw* fields
+	// hold the same headers exactly as received.
+	Subject    string
+	From       string
+	To         string
+	Cc         string
+	ReplyTo    string
+	RawSubject string
+	RawFrom    string
+	RawTo      string
+	RawCc      string
+	RawReplyTo string
+
+	TextBody string
+	HTMLBody string
+	Parts    []Part // leaf parts in document order, including the bodies
+}
+
+type Part struct {
+	Path         string // IMAP-style section number, e.g. "1" or "2.1"
+	ContentType  string
+	Charset      string
+	Filename     string
+	ContentID    string
+	Disposition  string
+	IsAttachment bool
+	Data         []byte // transfer-decoded; text bodies are converted to UTF-8
+}
+
+func Parse(raw []byte) (*Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message headers: %w", err)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message body: %w", err)
+	}
+
+	m := &Message{
+		Header:     msg.Header,
+		RawSubject: msg.Header.Get("Subject"),
+		RawFrom:    msg.Header.Get("From"),
+		RawTo:      msg.Header.Get("To"),
+		RawCc:      msg.Header.Get("Cc"),
+		RawReplyTo: msg.Header.Get("Reply-To"),
+	}
+	m.Subject = DecodeHeader(m.RawSubject)
+	m.From = DecodeHeader(m.RawFrom)
+	m.To = DecodeHeader(m.RawTo)
+	m.Cc = DecodeHeader(m.RawCc)
+	m.ReplyTo = DecodeHeader(m.RawReplyTo)
+	m.walk(textproto.MIMEHeader(msg.Header), body, "", 0)
+
+	for _, part := range m.Parts {
+		if part.IsAttachment {
+			continue
+		}
+		switch {
+		case part.ContentType == "text/plain" && m.TextBody == "":
+			m.TextBody = string(part.Data)
+		case part.ContentType == "text/html" && m.HTMLBody == "":
+			m.HTMLBody = string(part.Data)
+		}
+	}
+
+	return m, nil
+}
+
+func (m *Message) walk(header textproto.MIMEHeader, body []byte, path string, depth int) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxDepth {
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		index := 0
+		for {
+			p, err := reader.NextRawPart()
+			if err != nil {
+				break
+			}
+			data, err := io.ReadAll(p)
+			if err != nil {
+				break
+			}
+			index++
+			m.walk(p.Header, data, childPath(path, index), depth+1)
+		}
+		if index > 0 {
+			return
+		}
+		// A multipart without a single readable part is kept as text so the
+		// content is not lost.
+		mediaType = "text/plain"
+	}
+
+	if path == "" {
+		path = "1"
+	}
+
+	part := Part{
+		Path:        path,
+		ContentType: mediaType,
+		Charset:     strings.ToLower(params["charset"]),
+		ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+		Data:        decodeTransfer(header.Get("Content-Transfer-Encoding"), body),
+	}
+
+	disposition, dispParams, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil {
+		part.Disposition = disposition
+		part.Filename = dispParams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	// Many mailers put encoded words in filenames instead of using RFC 2231
+	part.Filename = DecodeHeader(part.Filename)
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	part.IsAttachment = part.Disposition == "attachment" || part.Filename != "" || !isText
+
+	if !part.IsAttachment {
+		part.Data = toUTF8(part.Charset, part.Data)
+	}
+
+	m.Parts = append(m.Parts, part)
+}
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// DecodeHeader decodes RFC 2047 encoded words in a header value. Values that
+// cannot be decoded are returned unchanged.
+func DecodeHeader(value string) string {
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// ParseAddressList returns the bare addresses in an address header such as
+// To or Cc. If the list as a whole is malformed, each comma-separated entry
+// is parsed on its own and entries that still fail are skipped.
+func ParseAddressList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		list = nil
+		for _, entry := range strings.Split(value, ",") {
+			if addr, err := addressParser.Parse(entry); err == nil {
+				list = append(list, addr)
+			}
+		}
+	}
+
+	addrs := make([]string, 0, len(list))
+	for _, addr := range list {
+		addrs = append(addrs, addr.Address)
+	}
+	return addrs
+}
+
+func childPath(parent string, index int) string {
+	if parent == "" {
+		return fmt.Sprintf("%d", index)
+	}
+	return fmt.Sprintf("%s.%d", parent, index)
+}
+
+func decodeTransfer(encoding string, data []byte) []byte {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		reader = base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: bytes.NewReader(data)})
+	case "quoted-printable":
+		reader = quotedprintable.NewReader(bytes.NewReader(data))
+	default:
+		return data
+	}
+
+	decoded, err := io.ReadAll(reader)
+	if err != nil && len(decoded) == 0 {
+		return data
+	}
+	return decoded
+}
+
+// base64Cleaner drops whitespace that the standard base64 decoder would
+// otherwise reject (it only skips CR and LF).
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	j := 0
+	for i := 0; i < n; i++ {
+		switch p[i] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		p[j] = p[i]
+		j++
+	}
+	return j, err
+}
+
+func toUTF8(charset string, data []byte) []byte {
+	switch charset {
+	case "", "utf-8", "us-ascii":
+		return data
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return data
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
@@ -0,0 +1,240 @@
+package message
+
+import (
+	"strings"
+	"testing"
+)
+
+func crlf(s string) []byte {
+	return []byte(strings.ReplaceAll(s, "\n", "\r\n"))
+}
+
+func TestParsePlainText(t *testing.T) {
+	raw := crlf(`Subject: Hello
+From: sender@example.com
+To: recipient@example.com
+
+Just some text.
+`)
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if msg.Subject != "Hello" {
+		t.Errorf("expected subject 'Hello', got %q", msg.Subject)
+	}
+	if msg.TextBody != "Just some text.\r\n" {
+		t.Errorf("unexpected text body: %q", msg.TextBody)
+	}
+	if msg.HTMLBody != "" {
+		t.Errorf("expected no HTML body, got %q", msg.HTMLBody)
+	}
+	if len(msg.Parts) != 1 || msg.Parts[0].Path != "1" {
+		t.Fatalf("expected a single part with path 1, got %+v", msg.Parts)
+	}
+	if msg.Parts[0].IsAttachment {
+		t.Error("expected the text part not to be an attachment")
+	}
+}
+
+func TestParseQuotedPrintableCharset(t *testing.T) {
+	raw := crlf(`Subject: Caf=E9
+Content-Type: text/plain; charset=ISO-8859-1
+Content-Transfer-Encoding: quoted-printable
+
+Caf=E9 au lait, s'il vous pla=EEt. Soft=
+ break.
+`)
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	expected := "Café au lait, s'il vous plaît. Soft break.\r\n"
+	if msg.TextBody != expected {
+		t.Errorf("expected %q, got %q", expected, msg.TextBody)
+	}
+	if msg.Parts[0].Charset != "iso-8859-1" {
+		t.Errorf("expected charset iso-8859-1, got %q", msg.Parts[0].Charset)
+	}
+}
+
+func TestParseMultipartWithAttachments(t *testing.T) {
+	raw := crlf(`Subject: Invoice
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+
+Your invoice is attached.
+--inner
+Content-Type: text/html; charset=utf-8
+Content-Transfer-Encoding: base64
+
+PHA+WW91ciBpbnZvaWNlIGlz
+IGF0dGFjaGVkLjwvcD4=
+--inner--
+--outer
+Content-Type: image/png
+Content-Disposition: inline
+Content-ID: <logo@example.com>
+Content-Transfer-Encoding: base64
+
+iVBORw0KGgo=
+--outer
+Content-Type: application/pdf; name="invoice.pdf"
+Content-Disposition: attachment; filename="invoice.pdf"
+Content-Transfer-Encoding: base64
+
+JVBERi0xLjQK
+--outer--
+`)
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if msg.TextBody != "Your invoice is attached." {
+		t.Errorf("unexpected text body: %q", msg.TextBody)
+	}
+	if msg.HTMLBody != "<p>Your invoice is attached.</p>" {
+		t.Errorf("unexpected HTML body: %q", msg.HTMLBody)
+	}
+
+	paths := []string{"1.1", "1.2", "2", "3"}
+	if len(msg.Parts) != len(paths) {
+		t.Fatalf("expected %d parts, got %d", len(paths), len(msg.Parts))
+	}
+	for i, path := range paths {
+		if msg.Parts[i].Path != path {
+			t.Errorf("expected part %d to have path %q, got %q", i, path, msg.Parts[i].Path)
+		}
+		// The bodies are parts 1.1 and 1.2, the rest are attachments
+		if expected := i >= 2; msg.Parts[i].IsAttachment != expected {
+			t.Errorf("expected part %s IsAttachment %v, got %v", path, expected, msg.Parts[i].IsAttachment)
+		}
+	}
+
+	image := msg.Parts[2]
+	if image.ContentType != "image/png" || image.Disposition != "inline" || image.ContentID != "logo@example.com" {
+		t.Errorf("unexpected inline image: %+v", image)
+	}
+	if string(image.Data) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("unexpected image data: %q", image.Data)
+	}
+
+	pdf := msg.Parts[3]
+	if pdf.Filename != "invoice.pdf" || pdf.ContentType != "application/pdf" {
+		t.Errorf("unexpected attachment: %+v", pdf)
+	}
+	if string(pdf.Data) != "%PDF-1.4\n" {
+		t.Errorf("unexpected attachment data: %q", pdf.Data)
+	}
+}
+
+func TestParseMissingBoundary(t *testing.T) {
+	raw := crlf(`Subject: Broken
+Content-Type: multipart/mixed
+
+no boundary here
+`)
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	if len(msg.Parts) != 1 {
+		t.Fatalf("expected 1 part, got %d", len(msg.Parts))
+	}
+	if !strings.Contains(string(msg.Parts[0].Data), "no boundary here") {
+		t.Errorf("expected content to be preserved, got %q", msg.Parts[0].Data)
+	}
+}
+
+func TestParseInvalidHeaders(t *testing.T) {
+	if _, err := Parse([]byte("this is not a header\r\n")); err == nil {
+		t.Error("expected error for malformed headers")
+	}
+}
+
+func TestParseEncodedWords(t *testing.T) {
+	raw := crlf(`Subject: =?UTF-8?B?SGVsbG8g8J+Ri20=?= =?UTF-8?Q?_W=C3=B6rld?=
+From: =?UTF-8?Q?Ren=C3=A9e_M=C3=BCller?= <renee@example.com>
+To: =?ISO-8859-1?Q?J=F6rg?= <jorg@example.com>, plain@example.com
+Cc: =?windows-1252?Q?Zo=EB?= <zoe@example.com>
+Reply-To: =?UTF-8?B?U3VwcG9ydA==?= <support@example.com>
+Content-Type: multipart/mixed; boundary=b
+
+--b
+Content-Type: text/plain
+
+Hi
+--b
+Content-Type: application/pdf
+Content-Disposition: attachment; filename="=?UTF-8?Q?R=C3=A9sum=C3=A9.pdf?="
+
+%PDF
+--b--
+`)
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	tests := []struct {
+		name, got, expected string
+	}{
+		{"Subject", msg.Subject, "Hello 👋m Wörld"},
+		{"From", msg.From, "Renée Müller <renee@example.com>"},
+		{"To", msg.To, "Jörg <jorg@example.com>, plain@example.com"},
+		{"Cc", msg.Cc, "Zoë <zoe@example.com>"},
+		{"Reply-To", msg.ReplyTo, "Support <support@example.com>"},
+		{"RawSubject", msg.RawSubject, "=?UTF-8?B?SGVsbG8g8J+Ri20=?= =?UTF-8?Q?_W=C3=B6rld?="},
+		{"RawFrom", msg.RawFrom, "=?UTF-8?Q?Ren=C3=A9e_M=C3=BCller?= <renee@example.com>"},
+		{"Filename", msg.Parts[1].Filename, "Résumé.pdf"},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, tt.got)
+		}
+	}
+}
+
+func TestDecodeHeaderInvalid(t *testing.T) {
+	value := "=?x-unknown-charset?Q?abc?="
+	if got := DecodeHeader(value); got != value {
+		t.Errorf("expected undecodable value to be returned as-is, got %q", got)
+	}
+}
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{"", nil},
+		{"alice@example.com", []string{"alice@example.com"}},
+		{`"Bob, Jr." <bob@example.com>, =?UTF-8?Q?Ren=C3=A9e?= <renee@example.com>`, []string{"bob@example.com", "renee@example.com"}},
+		{"Team: carol@example.com, dave@example.com;", []string{"carol@example.com", "dave@example.com"}},
+		{"not an address, erin@example.com", []string{"erin@example.com"}},
+		{"jürgen@bücher.example", []string{"jürgen@bücher.example"}},
+	}
+
+	for _, tt := range tests {
+		got := ParseAddressList(tt.value)
+		if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("ParseAddressList(%q) = %v, want %v", tt.value, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+var (
+	ErrNotConfigured = errors.New("no upstream server configured (relay.host)")
+	ErrNoRecipients  = errors.New("no recipients given and relay.release_to is empty")
+	ErrNotAllowed    = errors.New("recipient is not listed in relay.release_to")
+)
+
+// Relay sends captured messages on to the upstream SMTP server.
+type Relay struct {
+	config config.RelayConfig
+}
+
+func New(cfg config.RelayConfig) (*Relay, error) {
+	if cfg.Host == "" {
+		return nil, ErrNotConfigured
+	}
+	cfg.TLS = strings.ToLower(cfg.TLS)
+	switch cfg.TLS {
+	case "":
+		cfg.TLS = config.ListenerStartTLS
+	case config.ListenerPlain, config.ListenerStartTLS, config.ListenerTLS:
+	default:
+		return nil, fmt.Errorf("invalid relay.tls %q: must be %q, %q or %q",
+			cfg.TLS, config.ListenerPlain, config.ListenerStartTLS, config.ListenerTLS)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	return &Relay{config: cfg}, nil
+}
+
+// Addr returns the host:port of the upstream server.
+func (r *Relay) Addr() string {
+	return net.JoinHostPort(r.config.Host, strconv.Itoa(r.config.Port))
+}
+
+// Release sends the stored message unchanged to the given recipients, or to
+// relay.release_to if there are none, and returns the recipients used.
+func (r *Relay) Release(msg *database.Message, to []string) ([]string, error) {
+	if len(to) == 0 {
+		to = r.config.ReleaseTo
+	}
+	if len(to) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	sender := r.config.Sender
+	if sender == "" {
+		sender = msg.Sender
+	}
+	return to, r.Send(sender, to, msg.RawData)
+}
+
+// CheckAllowed returns ErrNotAllowed unless every address in to is listed
+// in relay.release_to. Releases from the API and TUI are limited to those
+// addresses, so DevSmtp cannot be used as an open relay.
+func (r *Relay) CheckAllowed(to []string) error {
+	for _, addr := range to {
+		allowed := false
+		for _, a := range r.config.ReleaseTo {
+			if strings.EqualFold(a, addr) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: %s", ErrNotAllowed, addr)
+		}
+	}
+	return nil
+}
+
+// AutoRelayRecipients returns the envelope recipients of msg that match a
+// relay.auto_relay pattern.
+func (r *Relay) AutoRelayRecipients(msg *database.Message) []string {
+	var matched []string
+	for _, rcpt := range msg.EnvelopeRecipients {
+		for _, pattern := range r.config.AutoRelay {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(rcpt.Address)); ok {
+				matched = append(matched, rcpt.Address)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// Send delivers data to the upstream server in a single SMTP transaction.
+// Every recipient must be accepted.
+func (r *Relay) Send(from string, to []string, data []byte) error {
+	addr := r.Addr()
+	tlsConfig := &tls.Config{
+		ServerName:         r.config.Host,
+		InsecureSkipVerify: r.config.InsecureSkipVerify,
+	}
+
+	dialer := &net.Dialer{Timeout: r.config.Timeout}
+	var conn net.Conn
+	var err error
+	if r.config.TLS == config.ListenerTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	if r.config.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(r.config.Timeout))
+	}
+
+	client, err := smtp.NewClient(conn, r.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", addr, err)
+	}
+	defer client.Close()
+
+	if r.config.TLS == config.ListenerStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("%s: STARTTLS failed: %w", addr, err)
+		}
+	}
+
+	if r.config.Username != "" {
+		// PlainAuth refuses to send the password unencrypted unless the
+		// upstream server is on localhost.
+		auth := smtp.PlainAuth("", r.config.Username, r.config.Password, r.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("%s: authentication failed: %w", addr, err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("%s: MAIL FROM:<%s> rejected: %w", addr, from, err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("%s: RCPT TO:<%s> rejected: %w", addr, rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("%s: DATA rejected: %w", addr, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("%s: failed to send message: %w", addr, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%s: message rejected: %w", addr, err)
+	}
+	return client.Quit()
+}
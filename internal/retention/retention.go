@@ -0,0 +1,88 @@
+package retention
+
+import (
+	"context"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/attachment"
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/smtp"
+)
+
+const defaultInterval = time.Minute
+
+// Janitor periodically prunes messages that fall outside the retention
+// policy and reclaims the space they used.
+type Janitor struct {
+	db       *database.DB
+	logger   *smtp.Logger
+	policy   database.RetentionPolicy
+	interval time.Duration
+}
+
+func New(cfg config.RetentionConfig, db *database.DB, logger *smtp.Logger) *Janitor {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	return &Janitor{
+		db:     db,
+		logger: logger,
+		policy: database.RetentionPolicy{
+			MaxMessages: cfg.MaxMessages,
+			MaxAge:      cfg.MaxAge,
+			MaxSize:     cfg.MaxSize,
+		},
+		interval: interval,
+	}
+}
+
+// Enabled reports whether any retention limit is set.
+func (j *Janitor) Enabled() bool {
+	return j.policy.MaxMessages > 0 || j.policy.MaxAge > 0 || j.policy.MaxSize > 0
+}
+
+// Run prunes once right away and then every interval until ctx is done. It
+// returns immediately if no limit is set.
+func (j *Janitor) Run(ctx context.Context) {
+	if !j.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if err := j.Prune(time.Now()); err != nil {
+			j.logger.Error("Retention: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes the messages outside the policy as of now, then vacuums the
+// database if anything was deleted.
+func (j *Janitor) Prune(now time.Time) error {
+	result, err := j.db.Prune(j.policy, now)
+	if err != nil {
+		return err
+	}
+	if result.Messages == 0 {
+		return nil
+	}
+
+	reclaimed, err := j.db.IncrementalVacuum()
+	if err != nil {
+		j.logger.Warn("Retention: pruned %d message(s) (%s), but vacuum failed: %v",
+			result.Messages, attachment.FormatSize(result.Size), err)
+		return nil
+	}
+	j.logger.Info("Retention: pruned %d message(s) (%s), reclaimed %s",
+		result.Messages, attachment.FormatSize(result.Size), attachment.FormatSize(reclaimed))
+	return nil
+}
@@ -0,0 +1,104 @@
+package retention
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/smtp"
+)
+
+func setupTestDB(t *testing.T, count int) *database.DB {
+	t.Helper()
+
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for i := 0; i < count; i++ {
+		msg := &database.Message{
+			Sender:     "sender@example.com",
+			Recipients: "rcpt@example.com",
+			RawData:    make([]byte, 2048),
+			Size:       2048,
+		}
+		if err := db.SaveMessage(msg); err != nil {
+			t.Fatalf("failed to save message: %v", err)
+		}
+	}
+	return db
+}
+
+func TestJanitorPrune(t *testing.T) {
+	db := setupTestDB(t, 3)
+	logger := smtp.NewLogger(10)
+
+	janitor := New(config.RetentionConfig{MaxMessages: 1}, db, logger)
+	if err := janitor.Prune(time.Now()); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("expected 1 message to be kept, got %d", len(messages))
+	}
+
+	select {
+	case entry := <-logger.Channel():
+		if entry.Level != smtp.LogInfo || !strings.Contains(entry.Message, "pruned 2 message(s) (4.0 KB)") {
+			t.Errorf("unexpected log entry: %s %s", entry.Level, entry.Message)
+		}
+	default:
+		t.Error("expected the prune to be logged")
+	}
+
+	// Nothing left to prune, nothing logged
+	if err := janitor.Prune(time.Now()); err != nil {
+		t.Fatalf("failed to prune: %v", err)
+	}
+	select {
+	case entry := <-logger.Channel():
+		t.Errorf("unexpected log entry: %s", entry.Message)
+	default:
+	}
+}
+
+func TestJanitorRun(t *testing.T) {
+	db := setupTestDB(t, 2)
+	logger := smtp.NewLogger(10)
+
+	// Without limits Run returns right away
+	disabled := New(config.RetentionConfig{}, db, logger)
+	if disabled.Enabled() {
+		t.Error("expected the janitor to be disabled without limits")
+	}
+	disabled.Run(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		New(config.RetentionConfig{MaxAge: time.Nanosecond, Interval: time.Hour}, db, logger).Run(ctx)
+	}()
+
+	select {
+	case entry := <-logger.Channel():
+		if !strings.Contains(entry.Message, "pruned 2 message(s)") {
+			t.Errorf("unexpected log entry: %s", entry.Message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected Run to prune right away")
+	}
+
+	cancel()
+	<-done
+}
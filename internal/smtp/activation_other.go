@@ -0,0 +1,9 @@
+//go:build !unix
+
+package smtp
+
+// activatedListeners returns nil: socket activation is only supported on
+// Unix systems.
+func activatedListeners() ([]*activatedListener, error) {
+	return nil, nil
+}
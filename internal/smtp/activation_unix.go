@@ -0,0 +1,64 @@
+//go:build unix
+
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+// (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// activatedListeners returns the sockets passed by systemd socket activation,
+// if any, in order.
+func activatedListeners() ([]*activatedListener, error) {
+	return listenFDs(listenFDsStart)
+}
+
+// listenFDs implements the sd_listen_fds protocol for sockets numbered from
+// start. The environment variables are removed so child processes do not
+// pick them up.
+func listenFDs(start int) ([]*activatedListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]*activatedListener, 0, count)
+	for i := range count {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, a := range listeners {
+				a.Close()
+			}
+			return nil, fmt.Errorf("socket activation: fd %d (%s) is not a listening socket: %w", fd, name, err)
+		}
+		listeners = append(listeners, &activatedListener{name: name, Listener: l})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package smtp
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+func TestListenFDs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("failed to get listener file: %v", err)
+	}
+	// listenFDs takes ownership of the descriptor
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to duplicate listener: %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "smtp")
+
+	// systemd passes the sockets from fd 3 on; here the duplicate is elsewhere
+	activated, err := listenFDs(fd)
+	if err != nil {
+		t.Fatalf("listenFDs failed: %v", err)
+	}
+	if len(activated) != 1 || activated[0].name != "smtp" {
+		t.Fatalf("expected one socket named smtp, got %+v", activated)
+	}
+	defer activated[0].Close()
+
+	if got := activated[0].Addr().String(); got != l.Addr().String() {
+		t.Errorf("expected the activated socket to listen on %s, got %s", l.Addr(), got)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("expected LISTEN_FDS to be unset")
+	}
+
+	// Sockets for another process are ignored
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if activated, err := listenFDs(fd); err != nil || activated != nil {
+		t.Errorf("expected no sockets for another process, got %+v (%v)", activated, err)
+	}
+}
+
+func TestListenWithFDName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	activated := []*activatedListener{{name: "smtp", Listener: l}}
+
+	if _, err := listen(config.ListenerConfig{FDName: "smtps"}, activated); err == nil {
+		t.Error("expected an error for an unknown socket name")
+	}
+	bound, err := listen(config.ListenerConfig{FDName: "smtp", Mode: "plain"}, activated)
+	if err != nil || len(bound) != 1 || bound[0].config.Mode != "plain" || !activated[0].used {
+		t.Fatalf("expected the activated socket to be used, got %+v (%v)", bound, err)
+	}
+	l.Close()
+}
@@ -0,0 +1,320 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+const (
+	OAuthModeAny    = "any"
+	OAuthModeStatic = "static"
+	OAuthModeRegex  = "regex"
+)
+
+// tokenValidator decides whether an OAuth bearer token presented by user is
+// accepted. A nil validator means OAuth mechanisms are disabled.
+type tokenValidator func(user, token string) bool
+
+func newTokenValidator(cfg config.OAuthConfig) (tokenValidator, error) {
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case OAuthModeAny:
+		return func(user, token string) bool {
+			return token != ""
+		}, nil
+	case OAuthModeStatic:
+		tokens := slices.Clone(cfg.Tokens)
+		return func(user, token string) bool {
+			return slices.Contains(tokens, token)
+		}, nil
+	case OAuthModeRegex:
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth.oauth.pattern: %w", err)
+		}
+		return func(user, token string) bool {
+			return re.MatchString(token)
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid auth.oauth.mode %q: must be %q, %q or %q", cfg.Mode, OAuthModeAny, OAuthModeStatic, OAuthModeRegex)
+	}
+}
+
+// authMechanisms returns the SASL mechanisms offered in EHLO.
+func (s *Server) authMechanisms() []string {
+	var mechanisms []string
+	if len(s.config.Auth.Credentials()) > 0 {
+		mechanisms = append(mechanisms, "PLAIN", "LOGIN", "CRAM-MD5")
+	}
+	if s.validateToken != nil {
+		mechanisms = append(mechanisms, "XOAUTH2", "OAUTHBEARER")
+	}
+	return mechanisms
+}
+
+func (sess *session) handleAuth(args string) {
+	mechanisms := sess.server.authMechanisms()
+	if len(mechanisms) == 0 {
+		sess.writeLine("503 Authentication not configured")
+		return
+	}
+	if sess.authenticated {
+		sess.writeLine("503 Already authenticated")
+		return
+	}
+
+	parts := strings.SplitN(args, " ", 2)
+	mechanism := strings.ToUpper(parts[0])
+
+	if !slices.Contains(mechanisms, mechanism) {
+		sess.writeLine("504 Unrecognized authentication mechanism")
+		return
+	}
+
+	sess.server.logger.Info("[%s] AUTH %s attempted", sess.clientIP, mechanism)
+
+	switch mechanism {
+	case "PLAIN":
+		sess.handleAuthPlain(parts)
+	case "LOGIN":
+		sess.handleAuthLogin()
+	case "CRAM-MD5":
+		sess.handleAuthCRAMMD5()
+	case "XOAUTH2":
+		sess.handleAuthXOAuth2(parts)
+	case "OAUTHBEARER":
+		sess.handleAuthOAuthBearer(parts)
+	}
+}
+
+// readAuthResponse reads one base64 encoded SASL response line. It reports
+// false if the connection failed or the client cancelled the exchange, in
+// which case the reply has already been sent.
+func (sess *session) readAuthResponse() ([]byte, bool) {
+	line, err := sess.reader.ReadString('\n')
+	if err != nil {
+		sess.readFailed(err)
+		return nil, false
+	}
+	line = strings.TrimSpace(line)
+	if line == "*" {
+		sess.writeLine("501 Authentication cancelled")
+		return nil, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		sess.writeLine("501 Invalid base64")
+		return nil, false
+	}
+	return decoded, true
+}
+
+// initialResponse returns the decoded initial response sent with the AUTH
+// command, or prompts for it with an empty challenge.
+func (sess *session) initialResponse(parts []string) ([]byte, bool) {
+	if len(parts) > 1 {
+		if parts[1] == "=" {
+			return []byte{}, true
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			sess.writeLine("501 Invalid base64")
+			return nil, false
+		}
+		return decoded, true
+	}
+
+	sess.writeLine("334 ")
+	return sess.readAuthResponse()
+}
+
+func (sess *session) authSucceeded(mechanism, username string) {
+	sess.authenticated = true
+	sess.authUser = username
+	sess.server.logger.Info("[%s] AUTH %s successful for user: %s", sess.clientIP, mechanism, username)
+	sess.writeLine("235 Authentication successful")
+}
+
+func (sess *session) authFailed(mechanism, username string) {
+	sess.server.logger.Warn("[%s] AUTH %s failed for user: %s", sess.clientIP, mechanism, username)
+	sess.writeLine("535 Authentication failed")
+}
+
+func (sess *session) handleAuthPlain(parts []string) {
+	decoded, ok := sess.initialResponse(parts)
+	if !ok {
+		return
+	}
+
+	// PLAIN format: authzid\0username\0password
+	credParts := strings.Split(string(decoded), "\x00")
+	if len(credParts) != 3 {
+		sess.writeLine("535 Authentication failed")
+		return
+	}
+
+	username := credParts[1]
+	password := credParts[2]
+
+	if sess.server.config.Auth.Verify(username, password) {
+		sess.authSucceeded("PLAIN", username)
+	} else {
+		sess.authFailed("PLAIN", username)
+	}
+}
+
+func (sess *session) handleAuthLogin() {
+	sess.writeLine("334 VXNlcm5hbWU6") // Base64 for "Username:"
+	userDecoded, ok := sess.readAuthResponse()
+	if !ok {
+		return
+	}
+
+	sess.writeLine("334 UGFzc3dvcmQ6") // Base64 for "Password:"
+	passDecoded, ok := sess.readAuthResponse()
+	if !ok {
+		return
+	}
+
+	username := string(userDecoded)
+	password := string(passDecoded)
+
+	if sess.server.config.Auth.Verify(username, password) {
+		sess.authSucceeded("LOGIN", username)
+	} else {
+		sess.authFailed("LOGIN", username)
+	}
+}
+
+func (sess *session) handleAuthCRAMMD5() {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+	challenge := fmt.Sprintf("<%x.%d@devsmtp>", nonce, time.Now().Unix())
+
+	sess.writeLine("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+	response, ok := sess.readAuthResponse()
+	if !ok {
+		return
+	}
+
+	// Response format: username SP hex(HMAC-MD5(password, challenge))
+	username, digest, found := strings.Cut(string(response), " ")
+	if !found {
+		sess.writeLine("501 Invalid CRAM-MD5 response")
+		return
+	}
+	got, err := hex.DecodeString(digest)
+	if err != nil {
+		sess.writeLine("501 Invalid CRAM-MD5 response")
+		return
+	}
+
+	for _, user := range sess.server.config.Auth.Credentials() {
+		if user.Username != username {
+			continue
+		}
+		mac := hmac.New(md5.New, []byte(user.Password))
+		mac.Write([]byte(challenge))
+		if hmac.Equal(mac.Sum(nil), got) {
+			sess.authSucceeded("CRAM-MD5", username)
+			return
+		}
+	}
+	sess.authFailed("CRAM-MD5", username)
+}
+
+// handleAuthXOAuth2 implements Google's XOAUTH2 mechanism, where the client
+// sends "user=<user>^Aauth=Bearer <token>^A^A".
+func (sess *session) handleAuthXOAuth2(parts []string) {
+	decoded, ok := sess.initialResponse(parts)
+	if !ok {
+		return
+	}
+
+	var user, token string
+	for _, field := range strings.Split(string(decoded), "\x01") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "user":
+			user = value
+		case "auth":
+			token = bearerToken(value)
+		}
+	}
+
+	sess.checkBearerToken("XOAUTH2", user, token, map[string]string{
+		"status":  "401",
+		"schemes": "Bearer",
+		"scope":   "https://mail.google.com/",
+	})
+}
+
+// handleAuthOAuthBearer implements RFC 7628, where the client sends a GS2
+// header followed by "^Aauth=Bearer <token>^A^A".
+func (sess *session) handleAuthOAuthBearer(parts []string) {
+	decoded, ok := sess.initialResponse(parts)
+	if !ok {
+		return
+	}
+
+	fields := strings.Split(string(decoded), "\x01")
+
+	// GS2 header: "n,a=user@example.com,"
+	var user string
+	for _, attr := range strings.Split(fields[0], ",") {
+		if value, found := strings.CutPrefix(attr, "a="); found {
+			user = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(value)
+		}
+	}
+
+	var token string
+	for _, field := range fields[1:] {
+		if value, found := strings.CutPrefix(field, "auth="); found {
+			token = bearerToken(value)
+		}
+	}
+
+	sess.checkBearerToken("OAUTHBEARER", user, token, map[string]string{
+		"status": "invalid_token",
+		"scope":  "email",
+	})
+}
+
+// checkBearerToken validates token and either completes the exchange or,
+// as both OAuth mechanisms require, sends an error challenge and waits for
+// the client's dummy response before failing.
+func (sess *session) checkBearerToken(mechanism, user, token string, failure map[string]string) {
+	if token != "" && sess.server.validateToken(user, token) {
+		sess.authSucceeded(mechanism, user)
+		return
+	}
+
+	challenge, _ := json.Marshal(failure)
+	sess.writeLine("334 " + base64.StdEncoding.EncodeToString(challenge))
+	if _, err := sess.reader.ReadString('\n'); err != nil {
+		sess.readFailed(err)
+		return
+	}
+	sess.authFailed(mechanism, user)
+}
+
+func bearerToken(value string) string {
+	scheme, token, found := strings.Cut(value, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
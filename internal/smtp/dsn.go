@@ -0,0 +1,232 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+// maxEnvIDLength is the longest ENVID accepted, as recommended by RFC 3461.
+const maxEnvIDLength = 100
+
+// decodeXtext decodes the xtext encoding used by ENVID and ORCPT, where
+// "+XX" stands for the byte with hex value XX.
+func decodeXtext(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) {
+				return "", errors.New("truncated hexchar")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+				return "", fmt.Errorf("invalid hexchar %q", s[i:i+3])
+			}
+			sb.WriteByte(byte(b))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid character %q", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
+
+func parseRet(value string) (string, error) {
+	switch ret := strings.ToUpper(value); ret {
+	case "FULL", "HDRS":
+		return ret, nil
+	default:
+		return "", errors.New("RET must be FULL or HDRS")
+	}
+}
+
+func parseEnvID(value string) (string, error) {
+	envID, err := decodeXtext(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid ENVID: %w", err)
+	}
+	if envID == "" || len(envID) > maxEnvIDLength {
+		return "", fmt.Errorf("ENVID must be 1-%d characters", maxEnvIDLength)
+	}
+	return envID, nil
+}
+
+func parseNotify(value string) (string, error) {
+	var keywords []string
+	for _, keyword := range strings.Split(strings.ToUpper(value), ",") {
+		switch keyword {
+		case "NEVER", "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return "", fmt.Errorf("unknown NOTIFY keyword %q", keyword)
+		}
+		for _, seen := range keywords {
+			if seen == keyword {
+				return "", fmt.Errorf("duplicate NOTIFY keyword %q", keyword)
+			}
+		}
+		keywords = append(keywords, keyword)
+	}
+	if len(keywords) > 1 && strings.Contains(strings.ToUpper(value), "NEVER") {
+		return "", errors.New("NOTIFY=NEVER cannot be combined with other keywords")
+	}
+	return strings.Join(keywords, ","), nil
+}
+
+func parseORCPT(value string) (string, error) {
+	addrType, addr, found := strings.Cut(value, ";")
+	if !found || addrType == "" {
+		return "", errors.New("ORCPT must be addr-type;xtext")
+	}
+	decoded, err := decodeXtext(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid ORCPT: %w", err)
+	}
+	if decoded == "" {
+		return "", errors.New("ORCPT address is empty")
+	}
+	return strings.ToLower(addrType) + ";" + decoded, nil
+}
+
+// dsnFails reports whether addr matches one of the configured failing
+// recipient patterns.
+func (s *Server) dsnFails(addr string) bool {
+	for _, pattern := range s.config.DSN.FailRecipients {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(addr)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsFailureDSN reports whether a failure report should be sent for rcpt.
+// Without NOTIFY, RFC 3461 leaves the choice to the server; DevSmtp reports
+// failures as most MTAs do.
+func wantsFailureDSN(rcpt database.Recipient) bool {
+	return rcpt.Notify == "" || strings.Contains(rcpt.Notify, "FAILURE")
+}
+
+// reportFailures stores a failure report addressed to the sender of msg for
+// every recipient matching dsn.fail_recipients. The original message has
+// already been captured; the report is captured alongside it.
+func (s *Server) reportFailures(msg *database.Message) {
+	if msg.Sender == "" {
+		return // never bounce a bounce
+	}
+
+	var failed []database.Recipient
+	for _, rcpt := range msg.EnvelopeRecipients {
+		if s.dsnFails(rcpt.Address) && wantsFailureDSN(rcpt) {
+			failed = append(failed, rcpt)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	raw := buildFailureDSN(hostname, msg, failed, time.Now())
+
+	report := &database.Message{
+		Recipients: msg.Sender,
+		RawData:    raw,
+		Size:       len(raw),
+		ClientIP:   msg.ClientIP,
+		AuthUser:   msg.AuthUser,
+		EnvelopeRecipients: []database.Recipient{
+			{Type: database.RecipientRcpt, Address: msg.Sender, Notify: "NEVER"},
+		},
+	}
+	if err := parseContent(report); err != nil {
+		s.logger.Warn("Failed to parse generated DSN: %v", err)
+	}
+	if err := s.db.SaveMessage(report); err != nil {
+		s.logger.Error("Failed to save DSN for message %d: %v", msg.ID, err)
+		return
+	}
+	s.logger.Info("DSN generated for message %d: %d failed recipient(s) reported to %s", msg.ID, len(failed), msg.Sender)
+}
+
+// buildFailureDSN returns a multipart/report (RFC 3464) telling the sender
+// of msg that delivery to failed did not succeed.
+func buildFailureDSN(hostname string, msg *database.Message, failed []database.Recipient, now time.Time) []byte {
+	boundary := randomToken()
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&buf, "To: <%s>\r\n", msg.Sender)
+	fmt.Fprintf(&buf, "Subject: Delivery Status Notification (Failure)\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", randomToken(), hostname)
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&buf, "\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "Delivery to the following recipients failed permanently:\r\n\r\n")
+	for _, rcpt := range failed {
+		fmt.Fprintf(&buf, "    %s\r\n", rcpt.Address)
+	}
+	fmt.Fprintf(&buf, "\r\nThis failure was simulated by DevSmtp (dsn.fail_recipients).\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", hostname)
+	if msg.DSNEnvID != "" {
+		fmt.Fprintf(&buf, "Original-Envelope-Id: %s\r\n", msg.DSNEnvID)
+	}
+	fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", now.Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		fmt.Fprintf(&buf, "\r\n")
+		if rcpt.ORCPT != "" {
+			fmt.Fprintf(&buf, "Original-Recipient: %s\r\n", rcpt.ORCPT)
+		}
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n", rcpt.Address)
+		fmt.Fprintf(&buf, "Action: failed\r\n")
+		fmt.Fprintf(&buf, "Status: 5.1.1\r\n")
+		fmt.Fprintf(&buf, "Diagnostic-Code: smtp; 550 5.1.1 <%s>: Recipient address rejected\r\n", rcpt.Address)
+	}
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	if msg.DSNRet == "FULL" {
+		fmt.Fprintf(&buf, "Content-Type: message/rfc822\r\n\r\n")
+		buf.Write(msg.RawData)
+	} else {
+		fmt.Fprintf(&buf, "Content-Type: text/rfc822-headers\r\n\r\n")
+		buf.Write(headerSection(msg.RawData))
+	}
+	fmt.Fprintf(&buf, "\r\n--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
+
+func headerSection(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if idx := bytes.Index(raw, []byte(sep)); idx >= 0 {
+			return raw[:idx]
+		}
+	}
+	return raw
+}
+
+func randomToken() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,237 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+// faultDataEnd is the pseudo-command matched after the message content has
+// been received with DATA or BDAT LAST, before it is stored.
+const faultDataEnd = "DATA_END"
+
+var errFaultDisconnect = errors.New("connection closed by fault rule")
+
+var faultCommands = []string{
+	"HELO", "EHLO", "MAIL", "RCPT", "DATA", "BDAT", "RSET", "NOOP",
+	"QUIT", "VRFY", "EXPN", "STARTTLS", "AUTH", "XCLIENT", "XFORWARD", faultDataEnd,
+}
+
+type faultRule struct {
+	index     int
+	command   string
+	sender    *regexp.Regexp
+	recipient *regexp.Regexp
+	clientNet *net.IPNet
+	authUser  string
+	every     int64
+
+	reply           string
+	delay           time.Duration
+	disconnect      bool
+	disconnectAfter int64 // bytes of message content
+}
+
+func newFaultRules(cfgs []config.FaultConfig) ([]faultRule, error) {
+	rules := make([]faultRule, 0, len(cfgs))
+	for i, cfg := range cfgs {
+		rule := faultRule{
+			index:           i,
+			command:         strings.ToUpper(cfg.Command),
+			authUser:        cfg.AuthUser,
+			every:           int64(cfg.Every),
+			delay:           cfg.Delay,
+			disconnect:      cfg.Disconnect,
+			disconnectAfter: int64(cfg.DisconnectAfterBytes),
+		}
+
+		if rule.command != "" && !slices.Contains(faultCommands, rule.command) {
+			return nil, fmt.Errorf("faults[%d]: unknown command %q", i, cfg.Command)
+		}
+		if cfg.Code == 0 && cfg.Delay == 0 && !cfg.Disconnect && cfg.DisconnectAfterBytes == 0 {
+			return nil, fmt.Errorf("faults[%d]: needs a code, delay, disconnect or disconnect_after_bytes", i)
+		}
+		if cfg.DisconnectAfterBytes != 0 {
+			if rule.command != "DATA" && rule.command != "BDAT" {
+				return nil, fmt.Errorf("faults[%d]: disconnect_after_bytes requires command DATA or BDAT", i)
+			}
+			if cfg.Code != 0 || cfg.Disconnect {
+				return nil, fmt.Errorf("faults[%d]: disconnect_after_bytes cannot be combined with code or disconnect", i)
+			}
+		}
+		if cfg.Code != 0 {
+			if cfg.Code < 200 || cfg.Code > 599 {
+				return nil, fmt.Errorf("faults[%d]: invalid reply code %d", i, cfg.Code)
+			}
+			text := cfg.Message
+			if text == "" {
+				text = "Injected fault"
+			}
+			rule.reply = fmt.Sprintf("%d %s", cfg.Code, text)
+		}
+		if cfg.Delay < 0 || cfg.Every < 0 || cfg.DisconnectAfterBytes < 0 {
+			return nil, fmt.Errorf("faults[%d]: delay, every and disconnect_after_bytes must not be negative", i)
+		}
+
+		var err error
+		if cfg.Sender != "" {
+			if rule.sender, err = regexp.Compile(cfg.Sender); err != nil {
+				return nil, fmt.Errorf("faults[%d]: invalid sender: %w", i, err)
+			}
+		}
+		if cfg.Recipient != "" {
+			if rule.recipient, err = regexp.Compile(cfg.Recipient); err != nil {
+				return nil, fmt.Errorf("faults[%d]: invalid recipient: %w", i, err)
+			}
+		}
+		if cfg.ClientIP != "" {
+			if rule.clientNet, err = parseIPNet(cfg.ClientIP); err != nil {
+				return nil, fmt.Errorf("faults[%d]: invalid client_ip: %w", i, err)
+			}
+		}
+
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseIPNet accepts a CIDR or a single address.
+func parseIPNet(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		return ipNet, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR", value)
+	}
+	bits := 8 * len(ip.To4())
+	if bits == 0 {
+		bits = 8 * net.IPv6len
+	} else {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (r *faultRule) matches(sess *session, cmd, args string) bool {
+	if r.command != "" && r.command != cmd {
+		return false
+	}
+	if r.authUser != "" && r.authUser != sess.authUser {
+		return false
+	}
+	if r.every > 0 && (sess.messageNum == 0 || sess.messageNum%r.every != 0) {
+		return false
+	}
+	if r.clientNet != nil {
+		ip := net.ParseIP(sess.clientIP)
+		if ip == nil || !r.clientNet.Contains(ip) {
+			return false
+		}
+	}
+
+	if r.sender != nil {
+		sender := sess.mailFrom
+		if cmd == "MAIL" && len(args) >= 5 {
+			sender, _, _ = splitPath(args[5:])
+		}
+		if (cmd != "MAIL" && !sess.inTransaction) || !r.sender.MatchString(sender) {
+			return false
+		}
+	}
+
+	if r.recipient != nil {
+		var recipients []string
+		if cmd == "RCPT" && len(args) >= 3 {
+			addr, _, _ := splitPath(args[3:])
+			recipients = append(recipients, addr)
+		} else {
+			for _, rcpt := range sess.recipients {
+				recipients = append(recipients, rcpt.Address)
+			}
+		}
+		if !slices.ContainsFunc(recipients, r.recipient.MatchString) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// injectFault applies the first rule matching cmd. It reports whether the
+// command was answered by the rule, and whether the connection was closed.
+func (sess *session) injectFault(cmd, args string) (handled, closed bool) {
+	rules := sess.server.faults
+	i := slices.IndexFunc(rules, func(r faultRule) bool {
+		return r.matches(sess, cmd, args)
+	})
+	if i < 0 {
+		return false, false
+	}
+	rule := rules[i]
+
+	if rule.delay > 0 {
+		sess.server.logger.Warn("[%s] Fault %d: delaying %s by %s", sess.clientIP, rule.index, cmd, rule.delay)
+		time.Sleep(rule.delay)
+	}
+	if rule.disconnectAfter > 0 {
+		// The command runs normally; readData and handleBdat count the content
+		if sess.dropFault == nil {
+			sess.dropFault = &rules[i]
+			sess.dropRemaining = rule.disconnectAfter
+		}
+		return false, false
+	}
+	if rule.reply == "" && !rule.disconnect {
+		return false, false
+	}
+
+	if cmd == "BDAT" && !rule.disconnect {
+		// Consume the chunk so the command stream stays in sync
+		if fields := strings.Fields(args); len(fields) > 0 {
+			if size, err := strconv.ParseInt(fields[0], 10, 64); err == nil && size > 0 {
+				_, _ = io.CopyN(io.Discard, dataReader{sess}, size)
+			}
+		}
+	}
+
+	if rule.reply != "" {
+		sess.server.logger.Warn("[%s] Fault %d: replying to %s with %q", sess.clientIP, rule.index, cmd, rule.reply)
+		sess.writeLine(rule.reply)
+	}
+	if rule.disconnect {
+		sess.server.logger.Warn("[%s] Fault %d: disconnecting at %s", sess.clientIP, rule.index, cmd)
+		sess.conn.Close()
+		return true, true
+	}
+	return true, false
+}
+
+// countContent counts n bytes of message content against the fault armed by
+// a disconnect_after_bytes rule, and closes the connection once the limit is
+// reached.
+func (sess *session) countContent(n int) error {
+	rule := sess.dropFault
+	if rule == nil {
+		return nil
+	}
+	sess.dropRemaining -= int64(n)
+	if sess.dropRemaining > 0 {
+		return nil
+	}
+
+	sess.server.logger.Warn("[%s] Fault %d: disconnecting after %d bytes of message content",
+		sess.clientIP, rule.index, rule.disconnectAfter)
+	sess.dropFault = nil
+	sess.conn.Close()
+	return errFaultDisconnect
+}
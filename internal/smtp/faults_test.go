@@ -0,0 +1,116 @@
+package smtp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+func TestFaultInjection(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Faults = []config.FaultConfig{
+			{Command: "rcpt", Recipient: "^busy@", Code: 450, Message: "4.2.1 Mailbox busy"},
+			{Command: "DATA_END", Recipient: "^drop@", Disconnect: true},
+			{Command: "DATA", Recipient: "^partial@", DisconnectAfterBytes: 64},
+			{Command: "DATA_END", Every: 2, Code: 554, Message: "5.6.0 Rejected"},
+			{Command: "MAIL", Sender: "^slow@", Delay: 200 * time.Millisecond},
+			{Command: "MAIL", ClientIP: "10.0.0.0/8", Code: 550},
+		}
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	expect := func(command, code string) {
+		t.Helper()
+		writeLine(t, conn, command)
+		if response := readLineReader(); !strings.HasPrefix(response, code) {
+			t.Fatalf("%s: expected %s, got: %q", command, code, response)
+		}
+	}
+	send := func(code string) {
+		t.Helper()
+		expect("DATA", "354")
+		writeLine(t, conn, "Subject: Fault")
+		writeLine(t, conn, "")
+		expect(".", code)
+	}
+
+	// Message 1: the RCPT rule rejects one recipient, the message is stored
+	expect("MAIL FROM:<sender@test.com>", "250")
+	writeLine(t, conn, "RCPT TO:<busy@test.com>")
+	if response := readLineReader(); response != "450 4.2.1 Mailbox busy" {
+		t.Errorf("expected injected 450, got: %q", response)
+	}
+	expect("RCPT TO:<ok@test.com>", "250")
+	send("250")
+
+	// Message 2: every second message is rejected after DATA
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<ok@test.com>", "250")
+	send("554")
+
+	// Message 3: delayed, then handled normally
+	start := time.Now()
+	expect("MAIL FROM:<slow@test.com>", "250")
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected MAIL to be delayed, took %s", elapsed)
+	}
+	expect("RCPT TO:<ok@test.com>", "250")
+	send("250")
+
+	// Message 4: the connection is dropped once the content has arrived
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<drop@test.com>", "250")
+	expect("DATA", "354")
+	writeLine(t, conn, "Subject: Fault")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); response != "" {
+		t.Errorf("expected the connection to be closed, got: %q", response)
+	}
+
+	// Message 5: the connection is dropped partway through the content
+	conn, readLineReader, _ = startAuthSession(t, port)
+	defer conn.Close()
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<partial@test.com>", "250")
+	expect("DATA", "354")
+	// One write: the server may reset the connection before a second one
+	_, _ = conn.Write([]byte("Subject: Fault\r\n\r\n" + strings.Repeat(strings.Repeat("x", 20)+"\r\n", 10)))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(make([]byte, 512))
+	if netErr, ok := err.(net.Error); n > 0 || err == nil || ok && netErr.Timeout() {
+		t.Errorf("expected the connection to be closed mid-DATA, got %d bytes, err %v", n, err)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("expected 2 stored messages, got %d", len(messages))
+	}
+}
+
+func TestInvalidFaultConfig(t *testing.T) {
+	for _, fault := range []config.FaultConfig{
+		{Command: "BOGUS", Code: 550},
+		{Command: "RCPT"},
+		{Command: "RCPT", Code: 99},
+		{Recipient: "(", Code: 550},
+		{ClientIP: "not-an-ip", Code: 550},
+		{Command: "RCPT", DisconnectAfterBytes: 10},
+		{Command: "DATA", DisconnectAfterBytes: 10, Code: 550},
+		{Command: "DATA", DisconnectAfterBytes: -1, Delay: time.Second},
+	} {
+		cfg := &config.Config{Faults: []config.FaultConfig{fault}}
+		if _, err := NewServer(cfg, nil, NewLogger(100)); err == nil {
+			t.Errorf("expected an error for %+v", fault)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package smtp
+
+import (
+	"strings"
+	"time"
+)
+
+// checkGreylist records the attempt to deliver to rcpt and reports whether it
+// may proceed. Rejected attempts have already been answered with 451.
+func (sess *session) checkGreylist(rcpt string) bool {
+	cfg := sess.server.config.Greylist
+	sender, rcpt := strings.ToLower(sess.mailFrom), strings.ToLower(rcpt)
+	now := time.Now()
+
+	entry, err := sess.server.db.RecordGreylistAttempt(sess.clientIP, sender, rcpt, now, cfg.Delay, cfg.Expire)
+	if err != nil {
+		// Fail open: a broken greylist should not stop mail from being captured
+		sess.server.logger.Error("[%s] Greylist lookup failed: %v", sess.clientIP, err)
+		return true
+	}
+
+	if entry.Passed() {
+		if entry.PassedAt.Equal(now) {
+			sess.server.logger.Info("[%s] Greylist passed: <%s> -> <%s> after %d attempts",
+				sess.clientIP, sender, rcpt, entry.Attempts)
+		} else {
+			sess.server.logger.Debug("[%s] Greylist known: <%s> -> <%s>", sess.clientIP, sender, rcpt)
+		}
+		return true
+	}
+
+	retryIn := entry.FirstSeen.Add(cfg.Delay).Sub(now).Round(time.Second)
+	sess.server.logger.Info("[%s] Greylisted: <%s> -> <%s> (attempt %d, retry in %s)",
+		sess.clientIP, sender, rcpt, entry.Attempts, retryIn)
+	sess.writeLine("451 4.7.1 Greylisted, please try again later")
+	return false
+}
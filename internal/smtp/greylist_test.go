@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+func TestGreylisting(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Greylist = config.GreylistConfig{Enabled: true, Delay: 300 * time.Millisecond, Expire: time.Hour}
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	expect := func(command, response string) {
+		t.Helper()
+		writeLine(t, conn, command)
+		if got := readLineReader(); !strings.HasPrefix(got, response) {
+			t.Errorf("%s: expected %q, got: %q", command, response, got)
+		}
+	}
+
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<user@test.com>", "451 4.7.1")
+	// Retrying too early is still rejected
+	expect("RCPT TO:<user@test.com>", "451 4.7.1")
+
+	time.Sleep(350 * time.Millisecond)
+	expect("RCPT TO:<User@Test.com>", "250")
+	// A new triplet is greylisted on its own
+	expect("RCPT TO:<other@test.com>", "451 4.7.1")
+
+	expect("DATA", "354")
+	writeLine(t, conn, "Subject: Greylisted")
+	writeLine(t, conn, "")
+	expect(".", "250")
+
+	// Once passed, the triplet is accepted right away
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<user@test.com>", "250")
+
+	pending, err := db.ListGreylist(true)
+	if err != nil {
+		t.Fatalf("failed to list greylist: %v", err)
+	}
+	if len(pending) != 1 || pending[0].Recipient != "other@test.com" || pending[0].ClientIP != "127.0.0.1" {
+		t.Errorf("expected only other@test.com to be pending, got %+v", pending)
+	}
+
+	all, err := db.ListGreylist(false)
+	if err != nil {
+		t.Fatalf("failed to list greylist: %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("expected 2 triplets, got %d", len(all))
+	}
+}
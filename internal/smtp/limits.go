@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows at most limit events per key within a sliding window.
+// A nil rateLimiter allows everything.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu        sync.Mutex
+	events    map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// allow records an event for key and reports whether it is within the limit.
+// Rejected events are not recorded.
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) > r.window {
+		// Forget keys that have gone quiet so the map does not grow forever
+		for k, events := range r.events {
+			if len(events) == 0 || now.Sub(events[len(events)-1]) > r.window {
+				delete(r.events, k)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	events := r.events[key]
+	for len(events) > 0 && now.Sub(events[0]) > r.window {
+		events = events[1:]
+	}
+	if len(events) >= r.limit {
+		r.events[key] = events
+		return false
+	}
+	r.events[key] = append(events, now)
+	return true
+}
+
+// admit applies the session and connection rate limits to a new session,
+// which is already tracked. It returns the rejection reply, or "" if the
+// session may proceed.
+func (s *Server) admit(sess *session) string {
+	limits := s.config.Limits
+
+	if limits.MaxSessions > 0 {
+		s.mu.Lock()
+		active := len(s.sessions)
+		s.mu.Unlock()
+		if active > limits.MaxSessions {
+			s.logger.Warn("[%s] Rejected: %d sessions active, limit is %d", sess.clientIP, active-1, limits.MaxSessions)
+			return "421 4.7.0 Too many connections, try again later"
+		}
+	}
+
+	if !s.connectionRate.allow(sess.clientIP, time.Now()) {
+		s.logger.Warn("[%s] Rejected: more than %d connections per minute", sess.clientIP, limits.ConnectionsPerMinute)
+		return "421 4.7.0 Too many connections from your IP, try again later"
+	}
+
+	return ""
+}
+
+// deadline returns the deadline for an operation allowed to take d, or the
+// zero time (no deadline) if d is not positive.
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+// extendDeadline gives the client d to send its next input and to accept
+// our next reply.
+func (sess *session) extendDeadline(d time.Duration) {
+	_ = sess.netConn.SetDeadline(deadline(d))
+}
+
+// readFailed handles a read error. If the client ran into a timeout it is
+// told so and the connection is closed; other errors mean the connection is
+// already gone.
+func (sess *session) readFailed(err error) {
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() || sess.server.shuttingDown() {
+		return
+	}
+
+	sess.server.logger.Warn("[%s] Timeout waiting for client, closing connection", sess.clientIP)
+	_ = sess.netConn.SetWriteDeadline(time.Now().Add(time.Second))
+	sess.writeLine("421 4.4.2 Timeout exceeded, closing connection")
+	sess.conn.Close()
+}
+
+// dataReader reads message content, giving the client the data timeout for
+// every block it sends.
+type dataReader struct {
+	sess *session
+}
+
+func (r dataReader) Read(p []byte) (int, error) {
+	r.sess.extendDeadline(r.sess.server.config.Limits.DataTimeout)
+	n, err := r.sess.reader.Read(p)
+	if err == nil {
+		err = r.sess.countContent(n)
+	}
+	return n, err
+}
@@ -0,0 +1,163 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, time.Minute)
+	now := time.Now()
+
+	if !limiter.allow("a", now) || !limiter.allow("a", now.Add(time.Second)) {
+		t.Fatal("expected the first two events to be allowed")
+	}
+	if limiter.allow("a", now.Add(2*time.Second)) {
+		t.Error("expected the third event to be rejected")
+	}
+	if !limiter.allow("b", now.Add(2*time.Second)) {
+		t.Error("expected other keys to be unaffected")
+	}
+	if !limiter.allow("a", now.Add(time.Minute+time.Second)) {
+		t.Error("expected the event to be allowed once the window has passed")
+	}
+
+	var unlimited *rateLimiter
+	if !unlimited.allow("a", now) {
+		t.Error("expected a nil limiter to allow everything")
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Limits.MaxSessions = 1
+	})
+	defer cleanup()
+
+	first := connectToServer(t, port)
+	if greeting := readLine(t, first); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("expected 220 greeting, got: %q", greeting)
+	}
+
+	second := connectToServer(t, port)
+	defer second.Close()
+	if response := readLine(t, second); response != "421 4.7.0 Too many connections, try again later" {
+		t.Errorf("expected 421 for the second session, got: %q", response)
+	}
+
+	writeLine(t, first, "QUIT")
+	readLine(t, first)
+	first.Close()
+
+	// The first session is untracked asynchronously once it has ended
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn := connectToServer(t, port)
+		greeting := readLine(t, conn)
+		conn.Close()
+		if strings.HasPrefix(greeting, "220") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a new session to be accepted, got: %q", greeting)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Limits.ConnectionsPerMinute = 2
+	})
+	defer cleanup()
+
+	for i := 0; i < 2; i++ {
+		conn := connectToServer(t, port)
+		if greeting := readLine(t, conn); !strings.HasPrefix(greeting, "220") {
+			t.Fatalf("connection %d: expected 220 greeting, got: %q", i+1, greeting)
+		}
+		conn.Close()
+	}
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+	if response := readLine(t, conn); response != "421 4.7.0 Too many connections from your IP, try again later" {
+		t.Errorf("expected 421 for the third connection, got: %q", response)
+	}
+}
+
+func TestMessageRateLimit(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Limits.MessagesPerMinute = 2
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+		if response := readLineReader(); !strings.HasPrefix(response, "250") {
+			t.Fatalf("message %d: expected 250, got: %q", i+1, response)
+		}
+		writeLine(t, conn, "RSET")
+		readLineReader()
+	}
+
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	if response := readLineReader(); response != "451 4.7.1 Message rate limit exceeded, try again later" {
+		t.Errorf("expected 451 for the third message, got: %q", response)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Limits.CommandTimeout = 200 * time.Millisecond
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	if response := readLineReader(); response != "421 4.4.2 Timeout exceeded, closing connection" {
+		t.Errorf("expected 421 after the idle timeout, got: %q", response)
+	}
+	if response := readLineReader(); response != "" {
+		t.Errorf("expected the connection to be closed, got: %q", response)
+	}
+}
+
+func TestDataTimeout(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Limits.DataTimeout = 200 * time.Millisecond
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	if response := readLineReader(); !strings.HasPrefix(response, "354") {
+		t.Fatalf("expected 354, got: %q", response)
+	}
+	writeLine(t, conn, "Subject: Stalled")
+
+	if response := readLineReader(); response != "421 4.4.2 Timeout exceeded, closing connection" {
+		t.Errorf("expected 421 after the data timeout, got: %q", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("expected no stored messages, got %d", len(messages))
+	}
+}
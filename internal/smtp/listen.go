@@ -0,0 +1,103 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+// activatedListener is a socket passed in by systemd socket activation.
+type activatedListener struct {
+	name string // from LISTEN_FDNAMES
+	net.Listener
+	used bool
+}
+
+// boundListener is an open listener with the settings it is served with.
+type boundListener struct {
+	net.Listener
+	config config.ListenerConfig
+}
+
+// listenNetwork returns the network to listen on for address. IP literals
+// are bound to their own family only, so "0.0.0.0" and "::" can share a
+// port.
+func listenNetwork(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// listen opens the listeners for lc. A listener with an FDName takes every
+// activated socket of that name.
+func listen(lc config.ListenerConfig, activated []*activatedListener) ([]boundListener, error) {
+	switch {
+	case lc.FDName != "":
+		var bound []boundListener
+		for _, a := range activated {
+			if a.name == lc.FDName && !a.used {
+				a.used = true
+				bound = append(bound, boundListener{a.Listener, lc})
+			}
+		}
+		if len(bound) == 0 {
+			return nil, fmt.Errorf("no socket named %q was passed by systemd", lc.FDName)
+		}
+		return bound, nil
+
+	case lc.Path != "":
+		if err := removeStaleSocket(lc.Path); err != nil {
+			return nil, err
+		}
+		l, err := net.Listen("unix", lc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", lc.Path, err)
+		}
+		return []boundListener{{l, lc}}, nil
+
+	default:
+		addr := lc.Addr()
+		l, err := net.Listen(listenNetwork(lc.Address), addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		return []boundListener{{l, lc}}, nil
+	}
+}
+
+// removeStaleSocket removes the socket file at path if it was left behind
+// by a process that is gone. A socket still accepting connections is kept,
+// so listening on it fails.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// unixClientIP describes the peer of a Unix socket connection, which has no
+// IP address: "unix" and, where the platform supports it, the peer's
+// credentials.
+func unixClientIP(conn *net.UnixConn) string {
+	creds, err := peerCredentials(conn)
+	if err != nil {
+		return "unix"
+	}
+	return "unix:" + creds
+}
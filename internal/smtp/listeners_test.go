@@ -0,0 +1,277 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+// freePort returns a port that was free on host a moment ago.
+func freePort(t *testing.T, host string) int {
+	t.Helper()
+	l, err := net.Listen(listenNetwork(host), net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", host, err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialEHLO connects to addr, sends EHLO and returns the connection, a line
+// reader and the EHLO response lines.
+func dialEHLO(t *testing.T, addr string) (net.Conn, func() string, []string) {
+	t.Helper()
+
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", addr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	readLineReader() // greeting
+	writeLine(t, conn, "EHLO localhost")
+	var ehlo []string
+	for {
+		line := readLineReader()
+		ehlo = append(ehlo, line)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+	return conn, readLineReader, ehlo
+}
+
+func TestListeners(t *testing.T) {
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	v4Port, v6Port := freePort(t, "127.0.0.1"), freePort(t, "::1")
+	authRequired, authOptional := true, false
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Address: "127.0.0.1", Port: v4Port, Mode: "plain", AuthRequired: &authOptional},
+				{Address: "::1", Port: v6Port, AuthRequired: &authRequired},
+			},
+		},
+		Auth: config.AuthConfig{Required: true, Username: "user", Password: "pass"},
+		TLS:  config.TLSConfig{Cert: certFile, Key: keyFile},
+	}
+	server, err := NewServer(cfg, db, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	}()
+
+	// Plain listener: no STARTTLS, and auth.required is overridden
+	conn, readLineReader, ehlo := dialEHLO(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(v4Port)))
+	defer conn.Close()
+	if slices.Contains(ehlo, "250-STARTTLS") {
+		t.Errorf("expected no STARTTLS on the plain listener, got: %v", ehlo)
+	}
+	writeLine(t, conn, "STARTTLS")
+	if response := readLineReader(); !strings.HasPrefix(response, "454") {
+		t.Errorf("expected 454 for STARTTLS on the plain listener, got: %q", response)
+	}
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Errorf("expected MAIL without AUTH to be accepted, got: %q", response)
+	}
+
+	// IPv6 STARTTLS listener that requires AUTH
+	conn6, readLineReader6, ehlo6 := dialEHLO(t, net.JoinHostPort("::1", strconv.Itoa(v6Port)))
+	defer conn6.Close()
+	if !slices.Contains(ehlo6, "250-STARTTLS") {
+		t.Errorf("expected STARTTLS on the starttls listener, got: %v", ehlo6)
+	}
+	writeLine(t, conn6, "MAIL FROM:<sender@test.com>")
+	if response := readLineReader6(); !strings.HasPrefix(response, "530") {
+		t.Errorf("expected 530 without AUTH, got: %q", response)
+	}
+}
+
+func TestListenAndServeFailsOnBusyPort(t *testing.T) {
+	port := freePort(t, "127.0.0.1")
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{
+				{Address: "127.0.0.1", Port: port},
+				{Address: "127.0.0.1", Port: port},
+			},
+		},
+	}
+	server, err := NewServer(cfg, nil, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	if err := server.ListenAndServe(); err == nil || !strings.Contains(err.Error(), "failed to listen") {
+		t.Fatalf("expected a listen error, got %v", err)
+	}
+
+	// The listener that was opened has been closed again
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("expected the port to be released: %v", err)
+	}
+	l.Close()
+}
+
+func TestInvalidListenerConfig(t *testing.T) {
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{{Address: "127.0.0.1", Port: 2525, Mode: "ssl"}},
+		},
+	}
+	if _, err := NewServer(cfg, nil, NewLogger(100)); err == nil {
+		t.Error("expected an error for an unknown listener mode")
+	}
+
+	// Implicit TLS needs a certificate
+	cfg.Server.Listeners[0].Mode = "tls"
+	server, err := NewServer(cfg, nil, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := server.ListenAndServe(); !errors.Is(err, errNoTLSConfig) {
+		t.Errorf("expected errNoTLSConfig, got %v", err)
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	for address, expected := range map[string]string{
+		"":            "tcp",
+		"localhost":   "tcp",
+		"0.0.0.0":     "tcp4",
+		"::":          "tcp6",
+		"2001:db8::1": "tcp6",
+	} {
+		if network := listenNetwork(address); network != expected {
+			t.Errorf("listenNetwork(%q) = %q, expected %q", address, network, expected)
+		}
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// Leave a stale socket behind, as a crashed process would
+	path := filepath.Join(t.TempDir(), "smtp.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("cannot listen on a Unix socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	cfg := &config.Config{
+		Server: config.ServerConfig{
+			Listeners: []config.ListenerConfig{{Path: path, Mode: "plain"}},
+		},
+	}
+	server, err := NewServer(cfg, db, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	}()
+
+	var conn net.Conn
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("unix", path); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	expect := func(command, code string) {
+		t.Helper()
+		if command != "" {
+			writeLine(t, conn, command)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		if !strings.HasPrefix(line, code) {
+			t.Fatalf("%q: expected %s, got: %q", command, code, line)
+		}
+	}
+	expect("", "220")
+	expect("HELO localhost", "250")
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<recipient@test.com>", "250")
+	expect("DATA", "354")
+	writeLine(t, conn, "Subject: Unix")
+	writeLine(t, conn, "")
+	expect(".", "250")
+
+	messages, err := db.GetMessages()
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d (%v)", len(messages), err)
+	}
+	expected := "unix"
+	if runtime.GOOS == "linux" {
+		expected = fmt.Sprintf("unix:pid=%d,uid=%d,gid=%d", os.Getpid(), os.Getuid(), os.Getgid())
+	}
+	if messages[0].ClientIP != expected {
+		t.Errorf("expected client %q, got %q", expected, messages[0].ClientIP)
+	}
+}
@@ -1,7 +1,10 @@
 package smtp
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"time"
 )
 
@@ -14,6 +17,11 @@ const (
 	LogDebug
 )
 
+const (
+	LogFormatPlain = "plain"
+	LogFormatJSON  = "json"
+)
+
 type LogEntry struct {
 	Time    time.Time
 	Level   LogLevel
@@ -43,6 +51,37 @@ func (e LogEntry) String() string {
 	)
 }
 
+func (e LogEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"message"`
+	}{
+		Time:    e.Time,
+		Level:   e.Level.String(),
+		Message: e.Message,
+	})
+}
+
+func (e LogEntry) Format(format string) (string, error) {
+	switch format {
+	case LogFormatPlain, "":
+		return fmt.Sprintf("%s %-5s %s",
+			e.Time.Format(time.RFC3339),
+			e.Level.String(),
+			e.Message,
+		), nil
+	case LogFormatJSON:
+		data, err := json.Marshal(e)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	default:
+		return "", fmt.Errorf("unknown log format %q", format)
+	}
+}
+
 type Logger struct {
 	ch chan LogEntry
 }
@@ -94,3 +133,40 @@ func (l *Logger) Debug(format string, args ...interface{}) {
 func (l *Logger) Channel() <-chan LogEntry {
 	return l.ch
 }
+
+// Drain writes log entries to out (info and debug) or errOut (warnings and
+// errors) until ctx is cancelled, then flushes whatever is still buffered.
+func (l *Logger) Drain(ctx context.Context, out, errOut io.Writer, format string) error {
+	write := func(entry LogEntry) error {
+		line, err := entry.Format(format)
+		if err != nil {
+			return err
+		}
+		w := out
+		if entry.Level == LogWarning || entry.Level == LogError {
+			w = errOut
+		}
+		_, err = fmt.Fprintln(w, line)
+		return err
+	}
+
+	for {
+		select {
+		case entry := <-l.ch:
+			if err := write(entry); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-l.ch:
+					if err := write(entry); err != nil {
+						return err
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
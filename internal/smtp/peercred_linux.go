@@ -0,0 +1,31 @@
+//go:build linux
+
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the process ID, user ID and group ID of the
+// process on the other end of conn, read with SO_PEERCRED.
+func peerCredentials(conn *net.UnixConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return "", err
+	}
+	if credErr != nil {
+		return "", credErr
+	}
+
+	return fmt.Sprintf("pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package smtp
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is only implemented on Linux.
+func peerCredentials(conn *net.UnixConn) (string, error) {
+	return "", errors.New("peer credentials are not supported on this platform")
+}
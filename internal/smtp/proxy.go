@@ -0,0 +1,182 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1MaxLength is the longest v1 header allowed, including the CRLF.
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("connection does not start with a PROXY header")
+
+// parseIPNets parses a list of trusted addresses and CIDRs from the config
+// setting named key.
+func parseIPNets(key string, values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		ipNet, err := parseIPNet(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip is in any of nets.
+func containsIP(nets []*net.IPNet, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY header a trusted proxy sends ahead of the
+// SMTP conversation and replaces the session's client IP with the source
+// address it carries. Connections from other peers are left alone.
+//
+// The header is read straight from the connection, one read per field, so
+// nothing after it is consumed before an implicit TLS handshake.
+func (sess *session) readProxyHeader() error {
+	if !sess.server.config.Proxy.Enabled || !containsIP(sess.server.proxyNets, sess.clientIP) {
+		return nil
+	}
+
+	_ = sess.netConn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer sess.netConn.SetReadDeadline(time.Time{})
+
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(sess.netConn, first); err != nil {
+		return err
+	}
+
+	var source string
+	var err error
+	switch first[0] {
+	case 'P':
+		source, err = readProxyV1(sess.netConn)
+	case proxyV2Signature[0]:
+		source, err = readProxyV2(sess.netConn)
+	default:
+		return errNoProxyHeader
+	}
+	if err != nil {
+		return err
+	}
+
+	if source == "" {
+		sess.server.logger.Debug("[%s] PROXY header without client address", sess.clientIP)
+		return nil
+	}
+	sess.server.logger.Debug("[%s] PROXY header: client is %s", sess.clientIP, source)
+	sess.proxyIP = sess.clientIP
+	sess.clientIP = source
+	return nil
+}
+
+// readProxyV1 reads the rest of a human-readable header, whose leading "P"
+// has been consumed, and returns the source address. It returns "" for
+// PROXY UNKNOWN.
+func readProxyV1(r io.Reader) (string, error) {
+	line := []byte{'P'}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return "", errors.New("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return "", errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return "", nil
+	case "TCP4", "TCP6":
+	default:
+		return "", fmt.Errorf("unsupported PROXY v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return "", errors.New("malformed PROXY v1 header")
+	}
+
+	source := net.ParseIP(fields[2])
+	if source == nil || net.ParseIP(fields[3]) == nil || (source.To4() != nil) != (fields[1] == "TCP4") {
+		return "", errors.New("malformed PROXY v1 address")
+	}
+	for _, port := range fields[4:] {
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			return "", errors.New("malformed PROXY v1 port")
+		}
+	}
+	return source.String(), nil
+}
+
+// readProxyV2 reads the rest of a binary header, whose first byte has been
+// consumed, and returns the source address. It returns "" for LOCAL
+// connections (e.g. health checks) and address families other than IPv4
+// and IPv6.
+func readProxyV2(r io.Reader) (string, error) {
+	header := make([]byte, 16)
+	header[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(r, header[1:]); err != nil {
+		return "", err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return "", errNoProxyHeader
+	}
+	if version := header[12] >> 4; version != 2 {
+		return "", fmt.Errorf("unsupported PROXY version %d", version)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", err
+	}
+
+	switch command := header[12] & 0x0f; command {
+	case 0x0: // LOCAL
+		return "", nil
+	case 0x1: // PROXY
+	default:
+		return "", fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	var size int
+	switch family := header[13] >> 4; family {
+	case 0x1: // AF_INET
+		size = net.IPv4len
+	case 0x2: // AF_INET6
+		size = net.IPv6len
+	default:
+		return "", nil
+	}
+	// Source and destination addresses, then both ports; TLVs are ignored
+	if len(payload) < 2*size+4 {
+		return "", errors.New("PROXY v2 address block too short")
+	}
+	return net.IP(payload[:size]).String(), nil
+}
@@ -0,0 +1,150 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+// sendThroughProxy writes header ahead of the SMTP conversation, delivers a
+// message and returns the client IP it was stored with.
+func sendThroughProxy(t *testing.T, trusted string, header []byte) string {
+	t.Helper()
+
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Proxy = config.ProxyConfig{Enabled: true, Trusted: []string{trusted}}
+	})
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+	if _, err := conn.Write(header); err != nil {
+		t.Fatalf("failed to write PROXY header: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	expect := func(command, code string) {
+		t.Helper()
+		if command != "" {
+			writeLine(t, conn, command)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		if !strings.HasPrefix(line, code) {
+			t.Fatalf("%q: expected %s, got: %q", command, code, line)
+		}
+	}
+	expect("", "220")
+	expect("HELO localhost", "250")
+	expect("MAIL FROM:<sender@test.com>", "250")
+	expect("RCPT TO:<recipient@test.com>", "250")
+	expect("DATA", "354")
+	writeLine(t, conn, "Subject: Proxied")
+	writeLine(t, conn, "")
+	expect(".", "250")
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	return messages[0].ClientIP
+}
+
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	header := []byte("PROXY TCP4 203.0.113.7 192.0.2.1 54321 25\r\n")
+	if ip := sendThroughProxy(t, "127.0.0.1", header); ip != "203.0.113.7" {
+		t.Errorf("expected client IP 203.0.113.7, got %q", ip)
+	}
+
+	header = []byte("PROXY UNKNOWN\r\n")
+	if ip := sendThroughProxy(t, "127.0.0.0/8", header); ip != "127.0.0.1" {
+		t.Errorf("expected the proxy address for UNKNOWN, got %q", ip)
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	var addrs bytes.Buffer
+	addrs.Write(net.ParseIP("2001:db8::7").To16())
+	addrs.Write(net.ParseIP("2001:db8::1").To16())
+	addrs.Write([]byte{0xd4, 0x31, 0x00, 0x19})
+	addrs.Write([]byte{0x04, 0x00, 0x01, 0x00}) // a TLV, ignored
+	if ip := sendThroughProxy(t, "127.0.0.1", proxyV2Header(0x1, 0x21, addrs.Bytes())); ip != "2001:db8::7" {
+		t.Errorf("expected client IP 2001:db8::7, got %q", ip)
+	}
+
+	addrs.Reset()
+	addrs.Write(net.ParseIP("198.51.100.9").To4())
+	addrs.Write(net.ParseIP("192.0.2.1").To4())
+	addrs.Write([]byte{0xd4, 0x31, 0x00, 0x19})
+	if ip := sendThroughProxy(t, "127.0.0.1", proxyV2Header(0x1, 0x11, addrs.Bytes())); ip != "198.51.100.9" {
+		t.Errorf("expected client IP 198.51.100.9, got %q", ip)
+	}
+
+	if ip := sendThroughProxy(t, "127.0.0.1", proxyV2Header(0x0, 0x00, nil)); ip != "127.0.0.1" {
+		t.Errorf("expected the proxy address for LOCAL, got %q", ip)
+	}
+}
+
+func TestProxyProtocolUntrustedPeer(t *testing.T) {
+	// Peers outside the allowlist are direct clients and send no header
+	if ip := sendThroughProxy(t, "10.0.0.0/8", nil); ip != "127.0.0.1" {
+		t.Errorf("expected client IP 127.0.0.1, got %q", ip)
+	}
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Proxy = config.ProxyConfig{Enabled: true, Trusted: []string{"127.0.0.1"}}
+	})
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	writeLine(t, conn, "EHLO localhost")
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("expected the connection to be closed, got: %q", line)
+	}
+}
+
+func TestReadProxyV1Errors(t *testing.T) {
+	for _, header := range []string{
+		"PROXY TCP4 203.0.113.7 192.0.2.1 54321\r\n",
+		"PROXY TCP4 2001:db8::7 192.0.2.1 54321 25\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 54321 99999\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 54321 25\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n",
+		"PROXZ TCP4 203.0.113.7 192.0.2.1 54321 25\r\n",
+	} {
+		// The caller consumes the leading "P"
+		if _, err := readProxyV1(strings.NewReader(header[1:])); err == nil {
+			t.Errorf("expected an error for %q", header)
+		}
+	}
+}
+
+func TestInvalidProxyConfig(t *testing.T) {
+	for _, trusted := range [][]string{nil, {"not-an-ip"}} {
+		cfg := &config.Config{Proxy: config.ProxyConfig{Enabled: true, Trusted: trusted}}
+		if _, err := NewServer(cfg, nil, NewLogger(100)); err == nil {
+			t.Errorf("expected an error for trusted %v", trusted)
+		}
+	}
+}
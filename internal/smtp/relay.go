@@ -0,0 +1,30 @@
+package smtp
+
+import (
+	"strings"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+// autoRelay sends msg upstream to the recipients matching relay.auto_relay.
+// It runs in the background so the client is not kept waiting on the
+// upstream server; the message is captured either way.
+func (s *Server) autoRelay(msg *database.Message) {
+	if s.relay == nil {
+		return
+	}
+	to := s.relay.AutoRelayRecipients(msg)
+	if len(to) == 0 {
+		return
+	}
+
+	s.relayWG.Add(1)
+	go func() {
+		defer s.relayWG.Done()
+		if _, err := s.relay.Release(msg, to); err != nil {
+			s.logger.Error("Failed to relay message %d to %s: %v", msg.ID, strings.Join(to, ", "), err)
+			return
+		}
+		s.logger.Info("Message %d relayed to %s via %s", msg.ID, strings.Join(to, ", "), s.relay.Addr())
+	}()
+}
@@ -0,0 +1,162 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/relay"
+)
+
+func TestRelayRelease(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	_, upstreamDB, _, upstreamPort, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.TLS = config.TLSConfig{Cert: certFile, Key: keyFile}
+		cfg.Auth = config.AuthConfig{Required: true, Username: "relay", Password: "secret"}
+	})
+	defer cleanup()
+
+	raw := []byte("From: sender@test.com\r\nTo: user@test.com\r\nSubject: Release me\r\n\r\nHello\r\n.dot")
+	msg := &database.Message{Sender: "sender@test.com", RawData: raw}
+
+	rl, err := relay.New(config.RelayConfig{
+		Host:               "127.0.0.1",
+		Port:               upstreamPort,
+		Username:           "relay",
+		Password:           "secret",
+		TLS:                config.ListenerStartTLS,
+		InsecureSkipVerify: true,
+		ReleaseTo:          []string{"inbox@test.com"},
+		Timeout:            2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+
+	to, err := rl.Release(msg, nil)
+	if err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if strings.Join(to, ",") != "inbox@test.com" {
+		t.Errorf("expected release to relay.release_to, got %v", to)
+	}
+
+	messages, err := upstreamDB.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 upstream message, got %d", len(messages))
+	}
+	got := messages[0]
+	if got.Sender != "sender@test.com" || got.Recipients != "inbox@test.com" {
+		t.Errorf("unexpected envelope: %s -> %s", got.Sender, got.Recipients)
+	}
+	if !got.TLS || got.AuthUser != "relay" {
+		t.Errorf("expected an authenticated TLS session, got tls %v user %q", got.TLS, got.AuthUser)
+	}
+	if !bytes.Equal(got.RawData, raw) {
+		t.Errorf("expected raw data %q, got %q", raw, got.RawData)
+	}
+}
+
+func TestRelayErrors(t *testing.T) {
+	_, _, _, upstreamPort, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if _, err := relay.New(config.RelayConfig{}); !errors.Is(err, relay.ErrNotConfigured) {
+		t.Errorf("expected ErrNotConfigured without a host, got %v", err)
+	}
+	if _, err := relay.New(config.RelayConfig{Host: "127.0.0.1", TLS: "ssl"}); err == nil {
+		t.Error("expected an invalid TLS mode to be rejected")
+	}
+
+	msg := &database.Message{Sender: "sender@test.com", RawData: []byte("Subject: x\r\n\r\nx\r\n")}
+
+	rl, err := relay.New(config.RelayConfig{Host: "127.0.0.1", Port: upstreamPort, TLS: config.ListenerPlain})
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+	if _, err := rl.Release(msg, nil); !errors.Is(err, relay.ErrNoRecipients) {
+		t.Errorf("expected ErrNoRecipients, got %v", err)
+	}
+
+	// STARTTLS is required unless the mode is plain
+	rl, err = relay.New(config.RelayConfig{Host: "127.0.0.1", Port: upstreamPort, Timeout: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("failed to create relay: %v", err)
+	}
+	if _, err := rl.Release(msg, []string{"inbox@test.com"}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("expected STARTTLS to be required, got %v", err)
+	}
+}
+
+func TestAutoRelay(t *testing.T) {
+	_, upstreamDB, _, upstreamPort, upstreamCleanup := setupTestServer(t)
+	defer upstreamCleanup()
+
+	server, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Relay = config.RelayConfig{
+			Host:      "127.0.0.1",
+			Port:      upstreamPort,
+			TLS:       config.ListenerPlain,
+			AutoRelay: []string{"*@RELAY.test"},
+			Timeout:   2 * time.Second,
+		}
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	for _, command := range []string{
+		"MAIL FROM:<sender@test.com>",
+		"RCPT TO:<someone@relay.test>",
+		"RCPT TO:<local@test.com>",
+		"DATA",
+	} {
+		writeLine(t, conn, command)
+		readLineReader()
+	}
+	writeLine(t, conn, "Subject: Auto relay")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %s", response)
+	}
+	writeLine(t, conn, "QUIT")
+	readLineReader()
+
+	// Shutdown waits for relays in progress
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down server: %v", err)
+	}
+
+	messages, err := upstreamDB.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 relayed message, got %d", len(messages))
+	}
+	if messages[0].Sender != "sender@test.com" || messages[0].Recipients != "someone@relay.test" {
+		t.Errorf("unexpected relayed envelope: %s -> %s", messages[0].Sender, messages[0].Recipients)
+	}
+	if messages[0].Subject != "Auto relay" {
+		t.Errorf("expected subject %q, got %q", "Auto relay", messages[0].Subject)
+	}
+}
+
+func TestAutoRelayRequiresHost(t *testing.T) {
+	cfg := &config.Config{Relay: config.RelayConfig{AutoRelay: []string{"*@relay.test"}}}
+	if _, err := NewServer(cfg, nil, NewLogger(10)); !errors.Is(err, relay.ErrNotConfigured) {
+		t.Errorf("expected ErrNotConfigured, got %v", err)
+	}
+}
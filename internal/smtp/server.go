@@ -2,108 +2,545 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
+	"github.com/lawnchairsociety/devsmtp/internal/certs"
 	"github.com/lawnchairsociety/devsmtp/internal/config"
 	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/message"
+	"github.com/lawnchairsociety/devsmtp/internal/relay"
 )
 
+var ErrServerClosed = errors.New("smtp: Server closed")
+
+var errNoTLSConfig = errors.New("implicit TLS requires a TLS certificate and key")
+
+var errMessageTooLarge = errors.New("message exceeds maximum size")
+
+const DefaultMaxMessageSize = 10 * 1024 * 1024
+
+const tlsHandshakeTimeout = 10 * time.Second
+
 type Server struct {
 	config    *config.Config
 	db        *database.DB
 	logger    *Logger
 	tlsConfig *tls.Config
+
+	validateToken tokenValidator
+	faults        []faultRule
+	messageCount  atomic.Int64 // MAIL commands seen, for fault rules
+
+	connectionRate *rateLimiter
+	messageRate    *rateLimiter
+	proxyNets      []*net.IPNet // peers allowed to send a PROXY header
+	xclientNets    []*net.IPNet // peers allowed to use XCLIENT and XFORWARD
+	relay          *relay.Relay // nil unless relay.auto_relay is set
+	relayWG        sync.WaitGroup
+
+	inShutdown atomic.Bool
+	mu         sync.Mutex
+	listeners  map[net.Listener]struct{}
+	sessions   map[*session]struct{}
+	sessionsWG sync.WaitGroup
 }
 
-func NewServer(cfg *config.Config, db *database.DB, logger *Logger) *Server {
+func NewServer(cfg *config.Config, db *database.DB, logger *Logger) (*Server, error) {
 	s := &Server{
-		config: cfg,
-		db:     db,
-		logger: logger,
+		config:    cfg,
+		db:        db,
+		logger:    logger,
+		listeners: make(map[net.Listener]struct{}),
+		sessions:  make(map[*session]struct{}),
+
+		connectionRate: newRateLimiter(cfg.Limits.ConnectionsPerMinute, time.Minute),
+		messageRate:    newRateLimiter(cfg.Limits.MessagesPerMinute, time.Minute),
+	}
+
+	validateToken, err := newTokenValidator(cfg.Auth.OAuth)
+	if err != nil {
+		return nil, err
+	}
+	s.validateToken = validateToken
+
+	if s.faults, err = newFaultRules(cfg.Faults); err != nil {
+		return nil, err
+	}
+	if len(s.faults) > 0 {
+		s.logger.Warn("Fault injection enabled: %d rule(s)", len(s.faults))
+	}
+
+	if cfg.Proxy.Enabled {
+		if len(cfg.Proxy.Trusted) == 0 {
+			return nil, errors.New("proxy_protocol.trusted must list at least one proxy address")
+		}
+		if s.proxyNets, err = parseIPNets("proxy_protocol.trusted", cfg.Proxy.Trusted); err != nil {
+			return nil, err
+		}
+	}
+	if s.xclientNets, err = parseIPNets("xclient.trusted", cfg.XClient.Trusted); err != nil {
+		return nil, err
+	}
+	if len(cfg.Relay.AutoRelay) > 0 {
+		if s.relay, err = relay.New(cfg.Relay); err != nil {
+			return nil, fmt.Errorf("relay.auto_relay: %w", err)
+		}
+		s.logger.Info("Auto-relaying %s to %s", strings.Join(cfg.Relay.AutoRelay, ", "), s.relay.Addr())
+	}
+	for i, l := range cfg.Server.ListenerConfigs() {
+		if l.Path != "" && l.FDName != "" {
+			return nil, fmt.Errorf("server.listeners[%d]: path and fd_name cannot both be set", i)
+		}
+		switch l.Mode {
+		case config.ListenerPlain, config.ListenerStartTLS, config.ListenerTLS:
+		default:
+			return nil, fmt.Errorf("server.listeners[%d]: unknown mode %q", i, l.Mode)
+		}
 	}
 
-	if cfg.TLS.Cert != "" && cfg.TLS.Key != "" {
+	switch {
+	case cfg.TLS.Cert != "" && cfg.TLS.Key != "":
 		cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
 		if err != nil {
-			s.logger.Warn("Failed to load TLS certificates: %v", err)
-		} else {
-			s.tlsConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-			}
-			s.logger.Info("TLS certificates loaded successfully")
+			return nil, fmt.Errorf("failed to load TLS certificates: %w", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
 		}
+		s.logger.Info("TLS certificates loaded successfully")
+	case cfg.TLS.Auto:
+		hosts := AutoTLSHosts(cfg)
+		bundle, err := certs.LoadOrCreate(cfg.TLS.AutoDir, hosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create self-signed TLS certificate: %w", err)
+		}
+		cert, err := bundle.TLSCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create self-signed TLS certificate: %w", err)
+		}
+		s.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+		s.logger.Info("Using self-signed TLS certificate for %s", strings.Join(hosts, ", "))
 	}
 
-	return s
+	return s, nil
 }
 
+// AutoTLSHosts returns the names the self-signed certificate is issued for.
+func AutoTLSHosts(cfg *config.Config) []string {
+	if len(cfg.TLS.AutoHosts) > 0 {
+		return cfg.TLS.AutoHosts
+	}
+	var bindHosts []string
+	for _, l := range cfg.Server.ListenerConfigs() {
+		bindHosts = append(bindHosts, l.Address)
+	}
+	return certs.DefaultHosts(bindHosts...)
+}
+
+// ListenAndServe listens on every configured listener and serves them until
+// Shutdown or Close is called. If a listener cannot be opened, none are
+// served. Otherwise it returns once any listener stops, with its error.
+//
+// Sockets passed by systemd socket activation are served by the listeners
+// naming them, or replace the default listeners if none are configured.
 func (s *Server) ListenAndServe() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Server.Host, s.config.Server.Port)
-	listener, err := net.Listen("tcp", addr)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+
+	activated, err := activatedListeners()
 	if err != nil {
-		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		return err
+	}
+
+	listenerConfigs := s.config.Server.ListenerConfigs()
+	if len(s.config.Server.Listeners) == 0 && len(activated) > 0 {
+		listenerConfigs = nil
+		for _, a := range activated {
+			if !slices.ContainsFunc(listenerConfigs, func(lc config.ListenerConfig) bool { return lc.FDName == a.name }) {
+				listenerConfigs = append(listenerConfigs, config.ListenerConfig{FDName: a.name, Mode: config.ListenerStartTLS})
+			}
+		}
+	}
+
+	var listeners []boundListener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, a := range activated {
+			if !a.used {
+				a.Close()
+			}
+		}
+	}
+	for _, lc := range listenerConfigs {
+		if lc.Mode == config.ListenerTLS && s.tlsConfig == nil {
+			closeAll()
+			return errNoTLSConfig
+		}
+		bound, err := listen(lc, activated)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, bound...)
+	}
+	for _, a := range activated {
+		if !a.used {
+			s.logger.Warn("Closing socket %q passed by systemd: no listener uses it", a.name)
+			a.Close()
+		}
 	}
-	defer listener.Close()
 
-	s.logger.Info("SMTP server listening on %s", addr)
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		s.logger.Info("SMTP server listening on %s (%s)", l.Addr(), l.config.Mode)
+		go func() {
+			errs <- s.ServeListener(l.Listener, l.config)
+		}()
+	}
+	return <-errs
+}
 
+// Serve accepts connections on l until Shutdown or Close is called, after
+// which it returns ErrServerClosed. STARTTLS is offered if a certificate is
+// configured.
+func (s *Server) Serve(l net.Listener) error {
+	return s.ServeListener(l, config.ListenerConfig{Mode: config.ListenerStartTLS})
+}
+
+// ServeTLS is like Serve, but completes a TLS handshake on every connection
+// before sending the greeting.
+func (s *Server) ServeTLS(l net.Listener) error {
+	return s.ServeListener(l, config.ListenerConfig{Mode: config.ListenerTLS})
+}
+
+// ServeListener is like Serve, with the mode and auth requirement of lc.
+// Its address and port are ignored.
+func (s *Server) ServeListener(l net.Listener, lc config.ListenerConfig) error {
+	if lc.Mode == config.ListenerTLS && s.tlsConfig == nil {
+		l.Close()
+		return errNoTLSConfig
+	}
+	return s.serve(l, lc)
+}
+
+func (s *Server) serve(l net.Listener, lc config.ListenerConfig) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	var retryDelay time.Duration
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			s.logger.Error("Failed to accept connection: %v", err)
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Back off on transient errors (e.g. too many open files)
+			// instead of spinning on Accept.
+			if retryDelay == 0 {
+				retryDelay = 5 * time.Millisecond
+			} else if retryDelay *= 2; retryDelay > time.Second {
+				retryDelay = time.Second
+			}
+			s.logger.Error("Failed to accept connection: %v; retrying in %v", err, retryDelay)
+			time.Sleep(retryDelay)
+			continue
+		}
+		retryDelay = 0
+
+		sess := s.newSession(conn)
+		sess.implicitTLS = lc.Mode == config.ListenerTLS
+		sess.startTLS = lc.Mode == config.ListenerStartTLS && s.tlsConfig != nil
+		sess.authRequired = s.config.Auth.Required
+		if lc.AuthRequired != nil {
+			sess.authRequired = *lc.AuthRequired
+		}
+		if !s.trackSession(sess, true) {
+			conn.Close()
 			continue
 		}
 
-		go s.handleConnection(conn)
+		go func() {
+			defer s.sessionsWG.Done()
+			defer s.trackSession(sess, false)
+			s.handleConnection(sess)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, tells idle sessions the service is
+// shutting down and waits for sessions in the middle of a command (such as a
+// DATA transfer) to finish. If ctx expires first, the remaining connections
+// are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	s.closeListenersLocked()
+	for sess := range s.sessions {
+		sess.interruptIfIdle()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessionsWG.Wait()
+		s.relayWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.closeSessions()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops the server immediately, closing all listeners and connections.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	s.closeListenersLocked()
+	s.mu.Unlock()
+
+	s.closeSessions()
+	s.sessionsWG.Wait()
+	s.relayWG.Wait()
+	return nil
+}
+
+func (s *Server) maxMessageSize() int {
+	if s.config.Server.MaxMessageSize > 0 {
+		return s.config.Server.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackSession(sess *session, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.sessions[sess] = struct{}{}
+		s.sessionsWG.Add(1)
+	} else {
+		delete(s.sessions, sess)
+	}
+	return true
+}
+
+func (s *Server) closeListenersLocked() {
+	for l := range s.listeners {
+		l.Close()
+		delete(s.listeners, l)
+	}
+}
+
+func (s *Server) closeSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sess := range s.sessions {
+		sess.netConn.Close()
 	}
 }
 
 type session struct {
 	server        *Server
+	netConn       net.Conn // underlying connection, never replaced by STARTTLS
 	conn          net.Conn
 	reader        *bufio.Reader
 	writer        *bufio.Writer
 	clientIP      string
+	proxyIP       string // address of the proxy the client connected through
+	clientName    string // hostname reported by XCLIENT
 	helo          string
 	mailFrom      string
-	rcptTo        []string
+	mailParams    map[string]string
+	rawMailParams string               // MAIL FROM parameters as sent
+	inTransaction bool                 // MAIL was accepted; mailFrom may be empty for the null path
+	smtputf8      bool                 // MAIL carried the SMTPUTF8 parameter
+	recipients    []database.Recipient // RCPT addresses with their DSN parameters
 	data          []byte
+	bdatActive    bool // BDAT chunks are being collected into data
 	authenticated bool
+	authUser      string
 	tlsActive     bool
-}
+	implicitTLS   bool  // TLS is negotiated before the greeting
+	startTLS      bool  // STARTTLS is offered
+	authRequired  bool  // MAIL requires SMTP AUTH on this listener
+	messageNum    int64 // server-wide sequence number of the latest MAIL command
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	xclientAllowed bool             // the peer may use XCLIENT and XFORWARD
+	xclientHelo    bool             // XCLIENT set helo; HELO and EHLO keep it
+	xforward       map[string]xattr // XFORWARD attributes for the next message
 
-	clientIP := conn.RemoteAddr().String()
-	if host, _, err := net.SplitHostPort(clientIP); err == nil {
-		clientIP = host
-	}
+	dropFault     *faultRule // disconnect_after_bytes rule armed for this message
+	dropRemaining int64      // content bytes left before dropFault closes the connection
 
-	s.logger.Info("New connection from %s", clientIP)
+	mu   sync.Mutex
+	idle bool // waiting for the next command
+}
+
+func (s *Server) newSession(conn net.Conn) *session {
+	var clientIP string
+	if unixConn, ok := conn.(*net.UnixConn); ok {
+		clientIP = unixClientIP(unixConn)
+	} else {
+		clientIP = conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+	}
 
-	sess := &session{
+	return &session{
 		server:   s,
+		netConn:  conn,
 		conn:     conn,
 		reader:   bufio.NewReader(conn),
 		writer:   bufio.NewWriter(conn),
 		clientIP: clientIP,
-		rcptTo:   make([]string, 0),
 	}
+}
+
+// setIdle marks the session as waiting for a command. It reports false if the
+// server is shutting down, in which case the session should not read again.
+func (sess *session) setIdle(idle bool) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if idle && sess.server.shuttingDown() {
+		return false
+	}
+	sess.idle = idle
+	return true
+}
+
+func (sess *session) interruptIfIdle() {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.idle {
+		// Unblock the pending read; the session loop notices the shutdown.
+		_ = sess.netConn.SetReadDeadline(time.Now())
+	}
+}
 
+func (s *Server) handleConnection(sess *session) {
+	defer sess.netConn.Close()
+
+	if err := sess.readProxyHeader(); err != nil {
+		s.logger.Error("[%s] Invalid PROXY header: %v", sess.clientIP, err)
+		return
+	}
+
+	sess.xclientAllowed = containsIP(s.xclientNets, sess.clientIP)
+
+	clientIP := sess.clientIP
+	if sess.proxyIP != "" {
+		s.logger.Info("New connection from %s via proxy %s", clientIP, sess.proxyIP)
+	} else {
+		s.logger.Info("New connection from %s", clientIP)
+	}
+
+	if sess.implicitTLS {
+		if err := sess.upgradeTLS(); err != nil {
+			s.logger.Error("[%s] TLS handshake failed: %v", clientIP, err)
+			return
+		}
+		s.logger.Debug("[%s] TLS handshake successful", clientIP)
+	}
+
+	if reply := s.admit(sess); reply != "" {
+		_ = sess.netConn.SetWriteDeadline(time.Now().Add(time.Second))
+		sess.writeLine(reply)
+		return
+	}
+
+	commandTimeout := s.config.Limits.CommandTimeout
+	sess.extendDeadline(commandTimeout)
 	sess.writeLine("220 DevSmtp ESMTP Service Ready")
 
 	for {
+		// Set before the session is marked idle, so it cannot overwrite the
+		// deadline Shutdown uses to interrupt the read.
+		sess.extendDeadline(commandTimeout)
+		if !sess.setIdle(true) {
+			sess.writeLine("421 Service shutting down")
+			s.logger.Info("Closing connection from %s: server shutting down", clientIP)
+			return
+		}
+
 		line, err := sess.reader.ReadString('\n')
+		sess.setIdle(false)
 		if err != nil {
+			if s.shuttingDown() {
+				_ = sess.netConn.SetWriteDeadline(time.Now().Add(time.Second))
+				sess.writeLine("421 Service shutting down")
+				s.logger.Info("Closing connection from %s: server shutting down", clientIP)
+				return
+			}
+			sess.readFailed(err)
 			s.logger.Info("Connection closed from %s", clientIP)
 			return
 		}
 
+		if s.shuttingDown() {
+			// The command arrived as the server began shutting down; let it
+			// finish without the deadline used to interrupt idle reads.
+			sess.extendDeadline(commandTimeout)
+		}
+
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
@@ -125,6 +562,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 }
 
 func (sess *session) handleCommand(cmd, args string) bool {
+	if cmd == "MAIL" {
+		sess.messageNum = sess.server.messageCount.Add(1)
+	}
+	if handled, closed := sess.injectFault(cmd, args); handled {
+		return closed
+	}
+
 	switch cmd {
 	case "HELO":
 		sess.handleHelo(args)
@@ -136,6 +580,8 @@ func (sess *session) handleCommand(cmd, args string) bool {
 		sess.handleRcptTo(args)
 	case "DATA":
 		sess.handleData()
+	case "BDAT":
+		sess.handleBdat(args)
 	case "RSET":
 		sess.handleRset()
 	case "NOOP":
@@ -152,6 +598,10 @@ func (sess *session) handleCommand(cmd, args string) bool {
 		sess.handleStartTLS()
 	case "AUTH":
 		sess.handleAuth(args)
+	case "XCLIENT":
+		sess.handleXClient(args)
+	case "XFORWARD":
+		sess.handleXForward(args)
 	default:
 		sess.server.logger.Warn("[%s] Unknown command: %s", sess.clientIP, cmd)
 		sess.writeLine("502 Command not implemented")
@@ -165,7 +615,9 @@ func (sess *session) handleHelo(args string) {
 		sess.writeLine("501 Syntax: HELO hostname")
 		return
 	}
-	sess.helo = args
+	if !sess.xclientHelo {
+		sess.helo = args
+	}
 	sess.server.logger.Info("[%s] HELO %s", sess.clientIP, args)
 	sess.writeLine("250 Hello " + args)
 }
@@ -175,27 +627,38 @@ func (sess *session) handleEhlo(args string) {
 		sess.writeLine("501 Syntax: EHLO hostname")
 		return
 	}
-	sess.helo = args
+	if !sess.xclientHelo {
+		sess.helo = args
+	}
 	sess.server.logger.Info("[%s] EHLO %s", sess.clientIP, args)
 
 	sess.writeLine("250-Hello " + args)
-	sess.writeLine("250-SIZE 10485760")
+	sess.writeLine(fmt.Sprintf("250-SIZE %d", sess.server.maxMessageSize()))
 	sess.writeLine("250-8BITMIME")
 	sess.writeLine("250-PIPELINING")
+	sess.writeLine("250-CHUNKING")
+	sess.writeLine("250-BINARYMIME")
+	sess.writeLine("250-SMTPUTF8")
+	sess.writeLine("250-DSN")
 
-	if sess.server.tlsConfig != nil && !sess.tlsActive {
+	if sess.startTLS && !sess.tlsActive {
 		sess.writeLine("250-STARTTLS")
 	}
 
-	if sess.server.config.Auth.Username != "" {
-		sess.writeLine("250-AUTH PLAIN LOGIN")
+	if mechanisms := sess.server.authMechanisms(); len(mechanisms) > 0 {
+		sess.writeLine("250-AUTH " + strings.Join(mechanisms, " "))
+	}
+
+	if sess.xclientAllowed {
+		sess.writeLine("250-XCLIENT " + strings.Join(xclientAttributes, " "))
+		sess.writeLine("250-XFORWARD " + strings.Join(xforwardAttributes, " "))
 	}
 
 	sess.writeLine("250 HELP")
 }
 
 func (sess *session) handleMailFrom(args string) {
-	if sess.server.config.Auth.Required && !sess.authenticated {
+	if sess.authRequired && !sess.authenticated {
 		sess.server.logger.Warn("[%s] AUTH required but not authenticated", sess.clientIP)
 		sess.writeLine("530 Authentication required")
 		return
@@ -207,17 +670,85 @@ func (sess *session) handleMailFrom(args string) {
 		return
 	}
 
-	addr := args[5:] // Keep original case
-	addr = strings.TrimSpace(addr)
-	addr = strings.Trim(addr, "<>")
+	addr, params, err := parsePath(args[5:]) // Keep original case
+	if err != nil {
+		sess.writeLine("501 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	if value, ok := params["SIZE"]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			sess.writeLine("501 Syntax error in SIZE parameter")
+			return
+		}
+		if size > int64(sess.server.maxMessageSize()) {
+			sess.server.logger.Warn("[%s] MAIL FROM:<%s> rejected: declared size %d exceeds %d bytes",
+				sess.clientIP, addr, size, sess.server.maxMessageSize())
+			sess.writeLine("552 Message size exceeds fixed maximum message size")
+			return
+		}
+	}
+
+	if value, ok := params["BODY"]; ok {
+		switch strings.ToUpper(value) {
+		case "7BIT", "8BITMIME", "BINARYMIME":
+			params["BODY"] = strings.ToUpper(value)
+		default:
+			sess.writeLine("501 Syntax error in BODY parameter")
+			return
+		}
+	}
 
+	smtputf8 := false
+	if value, ok := params["SMTPUTF8"]; ok {
+		if value != "" {
+			sess.writeLine("501 SMTPUTF8 does not take a value")
+			return
+		}
+		smtputf8 = true
+	}
+	if value, ok := params["RET"]; ok {
+		ret, err := parseRet(value)
+		if err != nil {
+			sess.writeLine("501 Syntax error in RET parameter: " + err.Error())
+			return
+		}
+		params["RET"] = ret
+	}
+	if value, ok := params["ENVID"]; ok {
+		envID, err := parseEnvID(value)
+		if err != nil {
+			sess.writeLine("501 Syntax error in ENVID parameter: " + err.Error())
+			return
+		}
+		params["ENVID"] = envID
+	}
+	if !sess.checkAddress(addr, smtputf8) {
+		return
+	}
+	if !sess.server.messageRate.allow(sess.clientIP, time.Now()) {
+		sess.server.logger.Warn("[%s] MAIL FROM:<%s> rejected: more than %d messages per minute",
+			sess.clientIP, addr, sess.server.config.Limits.MessagesPerMinute)
+		sess.writeLine("451 4.7.1 Message rate limit exceeded, try again later")
+		return
+	}
+
+	// XFORWARD attributes are sent ahead of MAIL and belong to this transaction
+	xforward := sess.xforward
+	sess.resetTransaction()
+	sess.xforward = xforward
+	sess.smtputf8 = smtputf8
 	sess.mailFrom = addr
+	sess.mailParams = params
+	_, sess.rawMailParams, _ = splitPath(args[5:])
+	sess.inTransaction = true
 	sess.server.logger.Info("[%s] MAIL FROM:<%s>", sess.clientIP, addr)
 	sess.writeLine("250 OK")
 }
 
 func (sess *session) handleRcptTo(args string) {
-	if sess.mailFrom == "" {
+	if !sess.inTransaction {
 		sess.writeLine("503 Need MAIL command first")
 		return
 	}
@@ -228,236 +759,430 @@ func (sess *session) handleRcptTo(args string) {
 		return
 	}
 
-	addr := args[3:] // Keep original case
-	addr = strings.TrimSpace(addr)
-	addr = strings.Trim(addr, "<>")
+	addr, params, err := parsePath(args[3:]) // Keep original case
+	if err != nil || addr == "" {
+		sess.writeLine("501 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	rcpt := database.Recipient{Type: database.RecipientRcpt, Address: addr}
+	if value, ok := params["NOTIFY"]; ok {
+		if rcpt.Notify, err = parseNotify(value); err != nil {
+			sess.writeLine("501 Syntax error in NOTIFY parameter: " + err.Error())
+			return
+		}
+	}
+	if value, ok := params["ORCPT"]; ok {
+		if rcpt.ORCPT, err = parseORCPT(value); err != nil {
+			sess.writeLine("501 Syntax error in ORCPT parameter: " + err.Error())
+			return
+		}
+	}
+	if !sess.checkAddress(addr, sess.smtputf8) {
+		return
+	}
+	if sess.server.config.Greylist.Enabled && !sess.checkGreylist(addr) {
+		return
+	}
 
-	sess.rcptTo = append(sess.rcptTo, addr)
+	sess.recipients = append(sess.recipients, rcpt)
 	sess.server.logger.Info("[%s] RCPT TO:<%s>", sess.clientIP, addr)
 	sess.writeLine("250 OK")
 }
 
 func (sess *session) handleData() {
-	if len(sess.rcptTo) == 0 {
+	if len(sess.recipients) == 0 {
 		sess.writeLine("503 Need RCPT command first")
 		return
 	}
+	if sess.bdatActive {
+		sess.writeLine("503 DATA not allowed after BDAT")
+		return
+	}
+	if sess.mailParams["BODY"] == "BINARYMIME" {
+		sess.writeLine("503 BINARYMIME requires BDAT")
+		return
+	}
 
 	sess.server.logger.Info("[%s] DATA started", sess.clientIP)
 	sess.writeLine("354 Start mail input; end with <CRLF>.<CRLF>")
 
-	var dataLines []string
-	for {
-		line, err := sess.reader.ReadString('\n')
-		if err != nil {
-			return
+	data, err := sess.readData(sess.server.maxMessageSize())
+	if errors.Is(err, errMessageTooLarge) {
+		sess.rejectTooLarge()
+		return
+	}
+	if err != nil {
+		sess.readFailed(err)
+		return
+	}
+	sess.data = data
+
+	sess.deliver()
+}
+
+// checkAddress rejects addresses that are not valid UTF-8, and non-ASCII
+// addresses in transactions that did not request SMTPUTF8 (RFC 6531).
+func (sess *session) checkAddress(addr string, smtputf8 bool) bool {
+	if !utf8.ValidString(addr) {
+		sess.writeLine("501 Address is not valid UTF-8")
+		return false
+	}
+	if !smtputf8 && !isASCII(addr) {
+		sess.server.logger.Warn("[%s] Rejected non-ASCII address without SMTPUTF8: %s", sess.clientIP, addr)
+		sess.writeLine("553 Non-ASCII address requires SMTPUTF8")
+		return false
+	}
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
 		}
+	}
+	return true
+}
 
-		line = strings.TrimRight(line, "\r\n")
-		if line == "." {
-			break
+// handleBdat implements BDAT from RFC 3030. The chunk is always read so the
+// command stream stays in sync, even when the command itself is rejected.
+func (sess *session) handleBdat(args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		sess.writeLine("501 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || size < 0 {
+		sess.writeLine("501 Syntax: BDAT <size> [LAST]")
+		return
+	}
+	last := len(fields) == 2
+	if last && !strings.EqualFold(fields[1], "LAST") {
+		sess.writeLine("501 Syntax: BDAT <size> [LAST]")
+		return
+	}
+
+	if len(sess.recipients) == 0 {
+		if _, err := io.CopyN(io.Discard, dataReader{sess}, size); err != nil {
+			sess.readFailed(err)
+			return
 		}
+		sess.writeLine("503 Need RCPT command first")
+		return
+	}
 
-		// Handle dot-stuffing
-		if strings.HasPrefix(line, "..") {
-			line = line[1:]
+	if !sess.bdatActive {
+		sess.server.logger.Info("[%s] BDAT started", sess.clientIP)
+		sess.bdatActive = true
+	}
+
+	// Written so that a size near MaxInt64 cannot overflow
+	limit := int64(sess.server.maxMessageSize())
+	if size > limit || int64(len(sess.data)) > limit-size {
+		if _, err := io.CopyN(io.Discard, dataReader{sess}, size); err != nil {
+			sess.readFailed(err)
+			return
 		}
+		sess.rejectTooLarge()
+		return
+	}
 
-		dataLines = append(dataLines, line)
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(dataReader{sess}, chunk); err != nil {
+		sess.readFailed(err)
+		return
 	}
+	sess.data = append(sess.data, chunk...)
 
-	rawData := strings.Join(dataLines, "\r\n")
-	sess.data = []byte(rawData)
+	if !last {
+		sess.writeLine(fmt.Sprintf("250 %d octets received", size))
+		return
+	}
 
-	// Parse subject from headers
-	subject := ""
-	body := rawData
-	if idx := strings.Index(rawData, "\r\n\r\n"); idx > 0 {
-		headers := rawData[:idx]
-		body = rawData[idx+4:]
-		for _, line := range strings.Split(headers, "\r\n") {
-			if strings.HasPrefix(strings.ToLower(line), "subject:") {
-				subject = strings.TrimSpace(line[8:])
-				break
-			}
-		}
-	} else if idx := strings.Index(rawData, "\n\n"); idx > 0 {
-		headers := rawData[:idx]
-		body = rawData[idx+2:]
-		for _, line := range strings.Split(headers, "\n") {
-			if strings.HasPrefix(strings.ToLower(line), "subject:") {
-				subject = strings.TrimSpace(line[8:])
-				break
-			}
-		}
+	sess.deliver()
+}
+
+func (sess *session) rejectTooLarge() {
+	sess.server.logger.Warn("[%s] Message rejected: exceeds %d bytes", sess.clientIP, sess.server.maxMessageSize())
+	sess.writeLine("552 Message size exceeds fixed maximum message size")
+	sess.resetTransaction()
+}
+
+// deliver stores the message in sess.data and ends the transaction.
+func (sess *session) deliver() {
+	if handled, _ := sess.injectFault(faultDataEnd, ""); handled {
+		sess.resetTransaction()
+		return
 	}
 
 	msg := &database.Message{
-		Sender:     sess.mailFrom,
-		Recipients: strings.Join(sess.rcptTo, ", "),
-		Subject:    subject,
-		Body:       body,
-		RawData:    sess.data,
-		Size:       len(sess.data),
-		ClientIP:   sess.clientIP,
-		IsRead:     false,
+		Sender:             sess.mailFrom,
+		Recipients:         sess.recipientList(),
+		RawData:            sess.data,
+		Size:               len(sess.data),
+		ClientIP:           sess.clientIP,
+		ClientName:         sess.clientName,
+		AuthUser:           sess.authUser,
+		SMTPUTF8:           sess.smtputf8,
+		Helo:               sess.helo,
+		MailParams:         sess.rawMailParams,
+		TLS:                sess.tlsActive,
+		Authenticated:      sess.authenticated,
+		DSNRet:             sess.mailParams["RET"],
+		DSNEnvID:           sess.mailParams["ENVID"],
+		EnvelopeRecipients: sess.recipients,
+		IsRead:             false,
+	}
+	sess.applyXForward(msg)
+
+	if err := parseContent(msg); err != nil {
+		sess.server.logger.Warn("[%s] Failed to parse MIME structure, storing body as-is: %v", sess.clientIP, err)
 	}
+	subject := msg.Subject
 
 	if err := sess.server.db.SaveMessage(msg); err != nil {
 		sess.server.logger.Error("[%s] Failed to save message: %v", sess.clientIP, err)
 		sess.writeLine("451 Requested action aborted: local error in processing")
+		sess.resetTransaction()
 		return
 	}
 
 	sess.server.logger.Info("[%s] Message received: %s -> %s (%d bytes) Subject: %s",
-		sess.clientIP, sess.mailFrom, strings.Join(sess.rcptTo, ", "), len(sess.data), subject)
+		sess.clientIP, sess.mailFrom, msg.Recipients, len(sess.data), subject)
+	sess.server.reportFailures(msg)
+	sess.server.autoRelay(msg)
 	sess.writeLine("250 OK: Message queued")
 
-	// Reset session state for next message
-	sess.mailFrom = ""
-	sess.rcptTo = make([]string, 0)
-	sess.data = nil
+	sess.resetTransaction()
+}
+
+// readData reads message content up to the terminating "." line, undoing
+// dot-stuffing and normalizing line endings to CRLF. At most max bytes are
+// kept; anything beyond that is read and discarded up to the terminator, and
+// errMessageTooLarge is returned.
+func (sess *session) readData(max int) ([]byte, error) {
+	var buf bytes.Buffer
+	tooLarge := false
+	lineStart := true
+
+	for {
+		sess.extendDeadline(sess.server.config.Limits.DataTimeout)
+		chunk, err := sess.reader.ReadSlice('\n')
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+		complete := err == nil
+		if err := sess.countContent(len(chunk)); err != nil {
+			return nil, err
+		}
+
+		if lineStart && complete && (string(chunk) == ".\r\n" || string(chunk) == ".\n") {
+			break
+		}
+		if lineStart && bytes.HasPrefix(chunk, []byte("..")) {
+			chunk = chunk[1:]
+		}
+
+		if !tooLarge {
+			if complete {
+				chunk = bytes.TrimSuffix(chunk, []byte("\n"))
+				if len(chunk) == 0 && !lineStart && bytes.HasSuffix(buf.Bytes(), []byte("\r")) {
+					// The CR of a CRLF split across two reads
+					buf.Truncate(buf.Len() - 1)
+				}
+				chunk = bytes.TrimSuffix(chunk, []byte("\r"))
+				buf.Write(chunk)
+				buf.WriteString("\r\n")
+			} else {
+				buf.Write(chunk)
+			}
+
+			// The CRLF ending the last line is not part of the message
+			if buf.Len()-2 > max {
+				tooLarge = true
+				buf = bytes.Buffer{}
+			}
+		}
+
+		lineStart = complete
+	}
+
+	if tooLarge {
+		return nil, errMessageTooLarge
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\r\n")), nil
+}
+
+// parseContent fills in the decoded headers, bodies and MIME parts of msg from
+// its raw data. If the message cannot be parsed, the text after the first
+// blank line is kept as the body so nothing is lost.
+func parseContent(msg *database.Message) error {
+	parsed, err := message.Parse(msg.RawData)
+	if err != nil {
+		rawData := string(msg.RawData)
+		msg.Body = rawData
+		for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+			idx := strings.Index(rawData, sep)
+			if idx <= 0 {
+				continue
+			}
+			msg.Body = rawData[idx+len(sep):]
+			for _, line := range strings.Split(rawData[:idx], sep[:len(sep)/2]) {
+				if strings.HasPrefix(strings.ToLower(line), "subject:") {
+					msg.RawSubject = strings.TrimSpace(line[8:])
+					msg.Subject = message.DecodeHeader(msg.RawSubject)
+					break
+				}
+			}
+			break
+		}
+		return err
+	}
+
+	msg.Subject = parsed.Subject
+	msg.RawSubject = parsed.RawSubject
+	msg.From, msg.RawFrom = parsed.From, parsed.RawFrom
+	msg.To, msg.RawTo = parsed.To, parsed.RawTo
+	msg.Cc, msg.RawCc = parsed.Cc, parsed.RawCc
+	msg.ReplyTo, msg.RawReplyTo = parsed.ReplyTo, parsed.RawReplyTo
+	for _, field := range []struct{ header, kind string }{
+		{"To", database.RecipientTo},
+		{"Cc", database.RecipientCc},
+		{"Bcc", database.RecipientBcc},
+	} {
+		for _, addr := range message.ParseAddressList(parsed.Header.Get(field.header)) {
+			msg.HeaderRecipients = append(msg.HeaderRecipients, database.Recipient{Type: field.kind, Address: addr})
+		}
+	}
+	msg.Body = parsed.TextBody
+	msg.HTMLBody = parsed.HTMLBody
+	for _, part := range parsed.Parts {
+		msg.Parts = append(msg.Parts, database.Part{
+			Path:         part.Path,
+			ContentType:  part.ContentType,
+			Charset:      part.Charset,
+			Filename:     part.Filename,
+			ContentID:    part.ContentID,
+			Disposition:  part.Disposition,
+			IsAttachment: part.IsAttachment,
+			Data:         part.Data,
+		})
+	}
+
+	return nil
 }
 
 func (sess *session) handleRset() {
-	sess.mailFrom = ""
-	sess.rcptTo = make([]string, 0)
-	sess.data = nil
+	sess.resetTransaction()
 	sess.server.logger.Debug("[%s] Session reset", sess.clientIP)
 	sess.writeLine("250 OK")
 }
 
 func (sess *session) handleStartTLS() {
-	if sess.server.tlsConfig == nil {
-		sess.writeLine("454 TLS not available")
+	if sess.tlsActive {
+		sess.writeLine("503 TLS already active")
 		return
 	}
 
-	if sess.tlsActive {
-		sess.writeLine("503 TLS already active")
+	if !sess.startTLS {
+		sess.writeLine("454 TLS not available")
 		return
 	}
 
 	sess.server.logger.Info("[%s] STARTTLS initiated", sess.clientIP)
 	sess.writeLine("220 Ready to start TLS")
 
-	tlsConn := tls.Server(sess.conn, sess.server.tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	if err := sess.upgradeTLS(); err != nil {
 		sess.server.logger.Error("[%s] TLS handshake failed: %v", sess.clientIP, err)
 		return
 	}
 
-	sess.conn = tlsConn
-	sess.reader = bufio.NewReader(tlsConn)
-	sess.writer = bufio.NewWriter(tlsConn)
-	sess.tlsActive = true
-
 	sess.server.logger.Info("[%s] TLS handshake successful", sess.clientIP)
 
 	// Reset session state after STARTTLS
-	sess.helo = ""
-	sess.mailFrom = ""
-	sess.rcptTo = make([]string, 0)
-	sess.authenticated = false
-}
-
-func (sess *session) handleAuth(args string) {
-	if sess.server.config.Auth.Username == "" {
-		sess.writeLine("503 Authentication not configured")
-		return
-	}
-
-	parts := strings.SplitN(args, " ", 2)
-	mechanism := strings.ToUpper(parts[0])
-
-	sess.server.logger.Info("[%s] AUTH %s attempted", sess.clientIP, mechanism)
-
-	switch mechanism {
-	case "PLAIN":
-		sess.handleAuthPlain(parts)
-	case "LOGIN":
-		sess.handleAuthLogin()
-	default:
-		sess.writeLine("504 Unrecognized authentication mechanism")
+	if !sess.xclientHelo {
+		sess.helo = ""
 	}
+	sess.resetTransaction()
+	sess.authenticated = false
+	sess.authUser = ""
 }
 
-func (sess *session) handleAuthPlain(parts []string) {
-	var credentials string
-
-	if len(parts) > 1 {
-		credentials = parts[1]
-	} else {
-		sess.writeLine("334 ")
-		line, err := sess.reader.ReadString('\n')
-		if err != nil {
-			return
-		}
-		credentials = strings.TrimSpace(line)
-	}
+// upgradeTLS performs the server side of the TLS handshake on the session's
+// connection and switches all further I/O to the encrypted stream.
+func (sess *session) upgradeTLS() error {
+	tlsConn := tls.Server(sess.conn, sess.server.tlsConfig)
 
-	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	_ = sess.netConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	_ = sess.netConn.SetDeadline(time.Time{})
 	if err != nil {
-		sess.writeLine("501 Invalid base64")
-		return
+		return err
 	}
 
-	// PLAIN format: \0username\0password
-	credParts := strings.Split(string(decoded), "\x00")
-	if len(credParts) != 3 {
-		sess.writeLine("535 Authentication failed")
-		return
-	}
-
-	username := credParts[1]
-	password := credParts[2]
+	sess.conn = tlsConn
+	sess.reader = bufio.NewReader(tlsConn)
+	sess.writer = bufio.NewWriter(tlsConn)
+	sess.tlsActive = true
+	return nil
+}
 
-	if username == sess.server.config.Auth.Username && password == sess.server.config.Auth.Password {
-		sess.authenticated = true
-		sess.server.logger.Info("[%s] AUTH successful for user: %s", sess.clientIP, username)
-		sess.writeLine("235 Authentication successful")
-	} else {
-		sess.server.logger.Warn("[%s] AUTH failed for user: %s", sess.clientIP, username)
-		sess.writeLine("535 Authentication failed")
+// recipientList returns the RCPT addresses as stored in Message.Recipients.
+func (sess *session) recipientList() string {
+	addrs := make([]string, len(sess.recipients))
+	for i, rcpt := range sess.recipients {
+		addrs[i] = rcpt.Address
 	}
+	return strings.Join(addrs, ", ")
 }
 
-func (sess *session) handleAuthLogin() {
-	sess.writeLine("334 VXNlcm5hbWU6") // Base64 for "Username:"
+func (sess *session) resetTransaction() {
+	sess.mailFrom = ""
+	sess.mailParams = nil
+	sess.rawMailParams = ""
+	sess.inTransaction = false
+	sess.recipients = nil
+	sess.data = nil
+	sess.bdatActive = false
+	sess.smtputf8 = false
+	sess.xforward = nil
+	sess.dropFault = nil
+}
 
-	userLine, err := sess.reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	userDecoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(userLine))
+// parsePath splits the argument of MAIL FROM: or RCPT TO: into the address
+// and its ESMTP parameters, whose keys are upper-cased. The null path "<>"
+// yields an empty address.
+func parsePath(arg string) (string, map[string]string, error) {
+	addr, rest, err := splitPath(arg)
 	if err != nil {
-		sess.writeLine("501 Invalid base64")
-		return
+		return "", nil, err
 	}
 
-	sess.writeLine("334 UGFzc3dvcmQ6") // Base64 for "Password:"
-
-	passLine, err := sess.reader.ReadString('\n')
-	if err != nil {
-		return
-	}
-	passDecoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(passLine))
-	if err != nil {
-		sess.writeLine("501 Invalid base64")
-		return
+	params := make(map[string]string)
+	for _, param := range strings.Fields(rest) {
+		key, value, _ := strings.Cut(param, "=")
+		params[strings.ToUpper(key)] = value
 	}
+	return addr, params, nil
+}
 
-	username := string(userDecoded)
-	password := string(passDecoded)
+// splitPath separates the address in a MAIL FROM: or RCPT TO: argument from
+// the parameter text that follows it.
+func splitPath(arg string) (addr, rest string, err error) {
+	arg = strings.TrimSpace(arg)
 
-	if username == sess.server.config.Auth.Username && password == sess.server.config.Auth.Password {
-		sess.authenticated = true
-		sess.server.logger.Info("[%s] AUTH LOGIN successful for user: %s", sess.clientIP, username)
-		sess.writeLine("235 Authentication successful")
+	if strings.HasPrefix(arg, "<") {
+		end := strings.Index(arg, ">")
+		if end < 0 {
+			return "", "", errors.New("unterminated path")
+		}
+		addr, rest = arg[1:end], arg[end+1:]
 	} else {
-		sess.server.logger.Warn("[%s] AUTH LOGIN failed for user: %s", sess.clientIP, username)
-		sess.writeLine("535 Authentication failed")
+		addr, rest, _ = strings.Cut(arg, " ")
 	}
+	return strings.TrimSpace(addr), strings.Join(strings.Fields(rest), " "), nil
 }
 
 func (sess *session) writeLine(line string) {
@@ -2,9 +2,24 @@ package smtp
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -15,6 +30,13 @@ import (
 
 func setupTestServer(t *testing.T) (*Server, *database.DB, *Logger, int, func()) {
 	t.Helper()
+	return setupTestServerWithConfig(t, nil)
+}
+
+// setupTestServerWithConfig is like setupTestServer, but lets configure
+// adjust the config before the server is created.
+func setupTestServerWithConfig(t *testing.T, configure func(*config.Config)) (*Server, *database.DB, *Logger, int, func()) {
+	t.Helper()
 
 	// Create temp database
 	tmpFile, err := os.CreateTemp("", "devsmtp-test-*.db")
@@ -29,13 +51,11 @@ func setupTestServer(t *testing.T) (*Server, *database.DB, *Logger, int, func())
 		t.Fatalf("failed to create database: %v", err)
 	}
 
-	// Find available port
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatalf("failed to find available port: %v", err)
+		t.Fatalf("failed to listen: %v", err)
 	}
 	port := listener.Addr().(*net.TCPAddr).Port
-	listener.Close()
 
 	cfg := &config.Config{
 		Server: config.ServerConfig{
@@ -44,18 +64,30 @@ func setupTestServer(t *testing.T) (*Server, *database.DB, *Logger, int, func())
 		},
 	}
 
+	if configure != nil {
+		configure(cfg)
+	}
+
 	logger := NewLogger(100)
-	server := NewServer(cfg, db, logger)
+	server, err := NewServer(cfg, db, logger)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
 
 	// Start server in background
+	served := make(chan struct{})
 	go func() {
-		_ = server.ListenAndServe()
+		defer close(served)
+		_ = server.Serve(listener)
 	}()
 
-	// Wait for server to be ready
-	time.Sleep(50 * time.Millisecond)
-
 	cleanup := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			t.Errorf("failed to shut down server: %v", err)
+		}
+		<-served
 		db.Close()
 		os.Remove(tmpFile.Name())
 	}
@@ -285,163 +317,1534 @@ func TestFullMessageFlow(t *testing.T) {
 	}
 }
 
-func TestNOOP(t *testing.T) {
-	_, _, _, port, cleanup := setupTestServer(t)
+func TestMultipartMessageParsed(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
 	defer cleanup()
 
 	conn := connectToServer(t, port)
 	defer conn.Close()
 
-	readLine(t, conn) // greeting
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
 
-	writeLine(t, conn, "NOOP")
-	response := readLine(t, conn)
+	readLineReader() // greeting
+	writeLine(t, conn, "HELO localhost")
+	readLineReader()
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
+
+	for _, line := range []string{
+		"Subject: Report",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b1"`,
+		"",
+		"--b1",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Caf=C3=A9 report attached.",
+		"--b1",
+		"Content-Type: text/calendar; name=invite.ics",
+		"Content-Disposition: attachment; filename=invite.ics",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"QkVHSU46VkNBTEVOREFS",
+		"--b1--",
+		".",
+	} {
+		writeLine(t, conn, line)
+	}
 
+	response := readLineReader()
 	if !strings.HasPrefix(response, "250") {
-		t.Errorf("expected 250 response, got: %s", response)
+		t.Fatalf("expected 250 response after DATA, got: %s", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+
+	msg := messages[0]
+	if msg.Body != "Café report attached." {
+		t.Errorf("expected decoded body, got %q", msg.Body)
+	}
+
+	attachments, err := db.GetAttachments(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get attachments: %v", err)
+	}
+	if len(attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(attachments))
+	}
+	if attachments[0].Filename != "invite.ics" || string(attachments[0].Data) != "BEGIN:VCALENDAR" {
+		t.Errorf("unexpected attachment: %s %q", attachments[0].Filename, attachments[0].Data)
 	}
 }
 
-func TestRSET(t *testing.T) {
-	_, _, _, port, cleanup := setupTestServer(t)
+func TestEncodedHeadersDecoded(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
 	defer cleanup()
 
 	conn := connectToServer(t, port)
 	defer conn.Close()
 
-	readLine(t, conn) // greeting
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	readLineReader() // greeting
 	writeLine(t, conn, "HELO localhost")
-	readLine(t, conn)
-	writeLine(t, conn, "MAIL FROM:<sender@example.com>")
-	readLine(t, conn)
+	readLineReader()
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
 
-	writeLine(t, conn, "RSET")
-	response := readLine(t, conn)
+	for _, line := range []string{
+		"Subject: =?UTF-8?B?w5xiZXJzaWNodA==?=",
+		"From: =?UTF-8?Q?J=C3=BCrgen?= <sender@test.com>",
+		"To: recipient@test.com",
+		"",
+		"Body",
+		".",
+	} {
+		writeLine(t, conn, line)
+	}
 
+	response := readLineReader()
 	if !strings.HasPrefix(response, "250") {
-		t.Errorf("expected 250 response, got: %s", response)
+		t.Fatalf("expected 250 response after DATA, got: %s", response)
 	}
 
-	// After RSET, RCPT should fail (no MAIL FROM)
-	writeLine(t, conn, "RCPT TO:<recipient@example.com>")
-	response = readLine(t, conn)
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
 
-	if !strings.HasPrefix(response, "503") {
-		t.Errorf("expected 503 response after RSET, got: %s", response)
+	msg := messages[0]
+	if msg.Subject != "Übersicht" {
+		t.Errorf("expected decoded subject, got %q", msg.Subject)
+	}
+	if msg.RawSubject != "=?UTF-8?B?w5xiZXJzaWNodA==?=" {
+		t.Errorf("expected raw subject to be kept, got %q", msg.RawSubject)
+	}
+	if msg.From != "Jürgen <sender@test.com>" {
+		t.Errorf("expected decoded from, got %q", msg.From)
 	}
 }
 
-func TestQUIT(t *testing.T) {
-	_, _, _, port, cleanup := setupTestServer(t)
-	defer cleanup()
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
 
-	conn := connectToServer(t, port)
-	defer conn.Close()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
 
-	readLine(t, conn) // greeting
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
 
-	writeLine(t, conn, "QUIT")
-	response := readLine(t, conn)
+func TestImplicitTLS(t *testing.T) {
+	db, err := database.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer db.Close()
 
-	if !strings.HasPrefix(response, "221") {
-		t.Errorf("expected 221 response, got: %s", response)
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.Config{
+		TLS: config.TLSConfig{Cert: certFile, Key: keyFile},
+	}
+	server, err := NewServer(cfg, db, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
 	}
-}
 
-func TestVRFY(t *testing.T) {
-	_, _, _, port, cleanup := setupTestServer(t)
-	defer cleanup()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeTLS(listener)
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+		if err := <-served; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("expected ErrServerClosed, got %v", err)
+		}
+	}()
 
-	conn := connectToServer(t, port)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to connect over TLS: %v", err)
+	}
 	defer conn.Close()
 
-	readLine(t, conn) // greeting
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
 
-	writeLine(t, conn, "VRFY user@example.com")
-	response := readLine(t, conn)
+	if greeting := readLineReader(); !strings.HasPrefix(greeting, "220") {
+		t.Fatalf("expected 220 greeting over TLS, got: %s", greeting)
+	}
 
-	if !strings.HasPrefix(response, "252") {
-		t.Errorf("expected 252 response, got: %s", response)
+	writeLine(t, conn, "EHLO localhost")
+	for {
+		line := readLineReader()
+		if strings.Contains(line, "STARTTLS") {
+			t.Error("STARTTLS must not be advertised on an implicit TLS connection")
+		}
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
 	}
-}
 
-func TestUnknownCommand(t *testing.T) {
-	_, _, _, port, cleanup := setupTestServer(t)
-	defer cleanup()
+	writeLine(t, conn, "STARTTLS")
+	if response := readLineReader(); !strings.HasPrefix(response, "503") {
+		t.Errorf("expected 503 for STARTTLS, got: %s", response)
+	}
 
-	conn := connectToServer(t, port)
-	defer conn.Close()
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
+	writeLine(t, conn, "Subject: Over TLS")
+	writeLine(t, conn, "")
+	writeLine(t, conn, "Secret")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %s", response)
+	}
 
-	readLine(t, conn) // greeting
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Subject != "Over TLS" {
+		t.Errorf("expected the message to be stored, got %+v", messages)
+	}
+}
 
-	writeLine(t, conn, "INVALID")
-	response := readLine(t, conn)
+func TestServeTLSWithoutCertificate(t *testing.T) {
+	server, _, _, _, cleanup := setupTestServer(t)
+	defer cleanup()
 
-	if !strings.HasPrefix(response, "502") {
-		t.Errorf("expected 502 response, got: %s", response)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if err := server.ServeTLS(listener); !errors.Is(err, errNoTLSConfig) {
+		t.Errorf("expected errNoTLSConfig, got %v", err)
 	}
 }
 
-func TestLogger(t *testing.T) {
-	logger := NewLogger(10)
+func TestAutoTLSCertificate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	cfg := &config.Config{
+		TLS: config.TLSConfig{Auto: true, AutoHosts: []string{"localhost"}, AutoDir: dir},
+	}
 
-	logger.Info("test message %d", 1)
-	logger.Warn("warning message")
-	logger.Error("error message")
-	logger.Debug("debug message")
+	server, err := NewServer(cfg, nil, NewLogger(100))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if server.tlsConfig == nil {
+		t.Fatal("expected a generated TLS config")
+	}
 
-	// Read from channel
-	entries := make([]LogEntry, 0)
-	timeout := time.After(100 * time.Millisecond)
+	ca, err := os.ReadFile(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("expected the CA to be cached: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
 
-loop:
-	for {
-		select {
-		case entry := <-logger.Channel():
-			entries = append(entries, entry)
-		case <-timeout:
-			break loop
-		}
+	leaf, err := x509.ParseCertificate(server.tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: pool}); err != nil {
+		t.Errorf("certificate does not verify against the exported CA: %v", err)
 	}
+}
 
-	if len(entries) != 4 {
-		t.Errorf("expected 4 log entries, got %d", len(entries))
+func TestInvalidTLSCertificate(t *testing.T) {
+	cfg := &config.Config{
+		TLS: config.TLSConfig{Cert: "/nonexistent/cert.pem", Key: "/nonexistent/key.pem"},
+	}
+	if _, err := NewServer(cfg, nil, NewLogger(100)); err == nil {
+		t.Error("expected an error for unreadable certificate files")
 	}
 }
 
-func TestLogEntryString(t *testing.T) {
-	entry := LogEntry{
-		Time:    time.Date(2025, 1, 15, 10, 30, 45, 0, time.UTC),
-		Level:   LogInfo,
-		Message: "test message",
+func TestAuthMultipleUsers(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.Required = true
+		cfg.Auth.Users = []config.UserConfig{
+			{Username: "team-a", Password: "secret-a"},
+			{Username: "team-b", Password: "secret-b"},
+		}
+	})
+	defer cleanup()
+
+	send := func(username, password string) string {
+		conn := connectToServer(t, port)
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		readLineReader := func() string {
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			line, _ := reader.ReadString('\n')
+			return strings.TrimSpace(line)
+		}
+
+		readLineReader() // greeting
+		writeLine(t, conn, "HELO localhost")
+		readLineReader()
+
+		creds := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00" + password))
+		writeLine(t, conn, "AUTH PLAIN "+creds)
+		if response := readLineReader(); !strings.HasPrefix(response, "235") {
+			return response
+		}
+
+		writeLine(t, conn, "MAIL FROM:<"+username+"@test.com>")
+		readLineReader()
+		writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+		readLineReader()
+		writeLine(t, conn, "DATA")
+		readLineReader()
+		writeLine(t, conn, "Subject: From "+username)
+		writeLine(t, conn, "")
+		writeLine(t, conn, "Body")
+		writeLine(t, conn, ".")
+		return readLineReader()
 	}
 
-	str := entry.String()
-	if !strings.Contains(str, "10:30:45") {
-		t.Errorf("expected time in string, got: %s", str)
+	for _, user := range []string{"team-a", "team-b"} {
+		if response := send(user, "secret-"+user[len(user)-1:]); !strings.HasPrefix(response, "250") {
+			t.Fatalf("expected %s to deliver, got: %s", user, response)
+		}
 	}
-	if !strings.Contains(str, "INFO") {
-		t.Errorf("expected INFO in string, got: %s", str)
+	if response := send("team-a", "secret-b"); !strings.HasPrefix(response, "535") {
+		t.Errorf("expected 535 for another user's password, got: %s", response)
 	}
-	if !strings.Contains(str, "test message") {
-		t.Errorf("expected message in string, got: %s", str)
+
+	messages, _, err := db.ListMessages(database.ListOptions{User: "team-b"})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].AuthUser != "team-b" || messages[0].Subject != "From team-b" {
+		t.Errorf("expected only team-b's message, got %+v", messages)
 	}
 }
 
-func TestLogLevel(t *testing.T) {
-	tests := []struct {
-		level    LogLevel
-		expected string
-	}{
-		{LogInfo, "INFO"},
-		{LogWarning, "WARN"},
-		{LogError, "ERROR"},
-		{LogDebug, "DEBUG"},
+// startAuthSession connects and sends EHLO, returning the connection and a
+// function that reads one reply line.
+func startAuthSession(t *testing.T, port int) (net.Conn, func() string, []string) {
+	t.Helper()
+
+	conn := connectToServer(t, port)
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
 	}
 
-	for _, tt := range tests {
+	readLineReader() // greeting
+	writeLine(t, conn, "EHLO localhost")
+	var ehlo []string
+	for {
+		line := readLineReader()
+		ehlo = append(ehlo, line)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+	return conn, readLineReader, ehlo
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func setupAuthTestServer(t *testing.T, oauth config.OAuthConfig) (int, func()) {
+	t.Helper()
+
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.Username = "user"
+		cfg.Auth.Password = "pass"
+		cfg.Auth.OAuth = oauth
+	})
+	return port, cleanup
+}
+
+func TestEHLOAdvertisesAuthMechanisms(t *testing.T) {
+	port, cleanup := setupAuthTestServer(t, config.OAuthConfig{Mode: OAuthModeAny})
+	defer cleanup()
+
+	conn, _, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	expected := "250-AUTH PLAIN LOGIN CRAM-MD5 XOAUTH2 OAUTHBEARER"
+	found := false
+	for _, line := range ehlo {
+		if line == expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %q in EHLO response, got %v", expected, ehlo)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	port, cleanup := setupAuthTestServer(t, config.OAuthConfig{})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	writeLine(t, conn, "AUTH LOGIN")
+	if response := readLineReader(); response != "334 VXNlcm5hbWU6" {
+		t.Fatalf("expected username prompt, got: %s", response)
+	}
+	writeLine(t, conn, b64("user"))
+	if response := readLineReader(); response != "334 UGFzc3dvcmQ6" {
+		t.Fatalf("expected password prompt, got: %s", response)
+	}
+	writeLine(t, conn, b64("pass"))
+	if response := readLineReader(); !strings.HasPrefix(response, "235") {
+		t.Errorf("expected 235, got: %s", response)
+	}
+}
+
+func TestAuthCRAMMD5(t *testing.T) {
+	port, cleanup := setupAuthTestServer(t, config.OAuthConfig{})
+	defer cleanup()
+
+	for _, tt := range []struct {
+		password string
+		expected string
+	}{
+		{"pass", "235"},
+		{"wrong", "535"},
+	} {
+		conn, readLineReader, _ := startAuthSession(t, port)
+
+		writeLine(t, conn, "AUTH CRAM-MD5")
+		response := readLineReader()
+		if !strings.HasPrefix(response, "334 ") {
+			t.Fatalf("expected challenge, got: %s", response)
+		}
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(response, "334 "))
+		if err != nil {
+			t.Fatalf("invalid challenge encoding: %v", err)
+		}
+
+		mac := hmac.New(md5.New, []byte(tt.password))
+		mac.Write(challenge)
+		writeLine(t, conn, b64("user "+hex.EncodeToString(mac.Sum(nil))))
+
+		if response := readLineReader(); !strings.HasPrefix(response, tt.expected) {
+			t.Errorf("password %q: expected %s, got: %s", tt.password, tt.expected, response)
+		}
+		conn.Close()
+	}
+}
+
+func TestAuthXOAuth2(t *testing.T) {
+	tests := []struct {
+		name   string
+		oauth  config.OAuthConfig
+		token  string
+		accept bool
+	}{
+		{"any", config.OAuthConfig{Mode: OAuthModeAny}, "anything", true},
+		{"static accepted", config.OAuthConfig{Mode: OAuthModeStatic, Tokens: []string{"t1", "t2"}}, "t2", true},
+		{"static rejected", config.OAuthConfig{Mode: OAuthModeStatic, Tokens: []string{"t1"}}, "t3", false},
+		{"regex accepted", config.OAuthConfig{Mode: OAuthModeRegex, Pattern: `^ya29\.`}, "ya29.abc", true},
+		{"regex rejected", config.OAuthConfig{Mode: OAuthModeRegex, Pattern: `^ya29\.`}, "abc", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port, cleanup := setupAuthTestServer(t, tt.oauth)
+			defer cleanup()
+
+			conn, readLineReader, _ := startAuthSession(t, port)
+			defer conn.Close()
+
+			writeLine(t, conn, "AUTH XOAUTH2 "+b64("user=me@example.com\x01auth=Bearer "+tt.token+"\x01\x01"))
+			response := readLineReader()
+
+			if tt.accept {
+				if !strings.HasPrefix(response, "235") {
+					t.Errorf("expected 235, got: %s", response)
+				}
+				return
+			}
+
+			// A rejected token gets an error challenge that the client
+			// acknowledges with an empty response.
+			if !strings.HasPrefix(response, "334 ") {
+				t.Fatalf("expected error challenge, got: %s", response)
+			}
+			writeLine(t, conn, "")
+			if response := readLineReader(); !strings.HasPrefix(response, "535") {
+				t.Errorf("expected 535, got: %s", response)
+			}
+		})
+	}
+}
+
+func TestAuthOAuthBearer(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Auth.OAuth = config.OAuthConfig{Mode: OAuthModeStatic, Tokens: []string{"good"}}
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	writeLine(t, conn, "AUTH OAUTHBEARER "+b64("n,a=bad@example.com,\x01host=localhost\x01port=587\x01auth=Bearer bad\x01\x01"))
+	if response := readLineReader(); !strings.HasPrefix(response, "334 ") {
+		t.Fatalf("expected error challenge, got: %s", response)
+	}
+	writeLine(t, conn, b64("\x01"))
+	if response := readLineReader(); !strings.HasPrefix(response, "535") {
+		t.Fatalf("expected 535, got: %s", response)
+	}
+
+	// Without an initial response the server prompts for it
+	writeLine(t, conn, "AUTH OAUTHBEARER")
+	if response := readLineReader(); response != "334" {
+		t.Fatalf("expected empty challenge, got: %q", response)
+	}
+	writeLine(t, conn, b64("n,a=me@example.com,\x01auth=Bearer good\x01\x01"))
+	if response := readLineReader(); !strings.HasPrefix(response, "235") {
+		t.Fatalf("expected 235, got: %s", response)
+	}
+
+	writeLine(t, conn, "MAIL FROM:<me@example.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
+	writeLine(t, conn, "Subject: OAuth")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	readLineReader()
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].AuthUser != "me@example.com" {
+		t.Errorf("expected the OAuth user to be recorded, got %+v", messages)
+	}
+}
+
+func TestAuthUnsupportedMechanism(t *testing.T) {
+	port, cleanup := setupAuthTestServer(t, config.OAuthConfig{})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	// OAuth mechanisms are only available when a validator is configured
+	writeLine(t, conn, "AUTH XOAUTH2 "+b64("user=me\x01auth=Bearer x\x01\x01"))
+	if response := readLineReader(); !strings.HasPrefix(response, "504") {
+		t.Errorf("expected 504, got: %s", response)
+	}
+}
+
+func TestInvalidOAuthConfig(t *testing.T) {
+	for _, oauth := range []config.OAuthConfig{
+		{Mode: "bogus"},
+		{Mode: OAuthModeRegex, Pattern: "("},
+	} {
+		cfg := &config.Config{Auth: config.AuthConfig{OAuth: oauth}}
+		if _, err := NewServer(cfg, nil, NewLogger(100)); err == nil {
+			t.Errorf("expected an error for %+v", oauth)
+		}
+	}
+}
+
+func TestSizeParameter(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Server.MaxMessageSize = 1000
+	})
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	found := false
+	for _, line := range ehlo {
+		if line == "250-SIZE 1000" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected configured SIZE in EHLO response, got %v", ehlo)
+	}
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"MAIL FROM:<sender@test.com> SIZE=1001", "552"},
+		{"MAIL FROM:<sender@test.com> SIZE=abc", "501"},
+		{"MAIL FROM:<sender@test.com> SIZE=1000", "250"},
+		{"MAIL FROM:<> SIZE=10", "250"},
+	}
+	for _, tt := range tests {
+		writeLine(t, conn, tt.command)
+		if response := readLineReader(); !strings.HasPrefix(response, tt.expected) {
+			t.Errorf("%s: expected %s, got: %s", tt.command, tt.expected, response)
+		}
+	}
+
+	// The null sender from the last MAIL still allows recipients
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Errorf("expected 250 after MAIL FROM:<>, got: %s", response)
+	}
+}
+
+func TestDataExceedsMaxSize(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Server.MaxMessageSize = 1000
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	send := func(body string) string {
+		writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+		readLineReader()
+		writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+		readLineReader()
+		writeLine(t, conn, "DATA")
+		readLineReader()
+		writeLine(t, conn, "Subject: Size test")
+		writeLine(t, conn, "")
+		writeLine(t, conn, body)
+		writeLine(t, conn, ".")
+		return readLineReader()
+	}
+
+	// A single line longer than both the limit and the read buffer
+	if response := send(strings.Repeat("x", 8000)); response != "552 Message size exceeds fixed maximum message size" {
+		t.Errorf("expected 552, got: %s", response)
+	}
+
+	// The session stays usable and the transaction was reset
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	if response := readLineReader(); !strings.HasPrefix(response, "503") {
+		t.Errorf("expected 503 after rejected message, got: %s", response)
+	}
+
+	// "Subject: Size test\r\n\r\n" is 22 bytes
+	if response := send(strings.Repeat("y", 1000-22)); !strings.HasPrefix(response, "250") {
+		t.Errorf("expected a message at the limit to be accepted, got: %s", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 || messages[0].Size != 1000 {
+		t.Errorf("expected one message of 1000 bytes, got %+v", messages)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		addr   string
+		params map[string]string
+	}{
+		{"<user@example.com>", "user@example.com", map[string]string{}},
+		{" <user@example.com> SIZE=100 body=8BITMIME", "user@example.com", map[string]string{"SIZE": "100", "BODY": "8BITMIME"}},
+		{"<>", "", map[string]string{}},
+		{"user@example.com SMTPUTF8", "user@example.com", map[string]string{"SMTPUTF8": ""}},
+	}
+
+	for _, tt := range tests {
+		addr, params, err := parsePath(tt.arg)
+		if err != nil {
+			t.Errorf("parsePath(%q) failed: %v", tt.arg, err)
+			continue
+		}
+		if addr != tt.addr {
+			t.Errorf("parsePath(%q) address = %q, expected %q", tt.arg, addr, tt.addr)
+		}
+		if fmt.Sprint(params) != fmt.Sprint(tt.params) {
+			t.Errorf("parsePath(%q) params = %v, expected %v", tt.arg, params, tt.params)
+		}
+	}
+
+	if _, _, err := parsePath("<user@example.com"); err == nil {
+		t.Error("expected an error for an unterminated path")
+	}
+}
+
+func TestBdatPipelined(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	for _, ext := range []string{"250-CHUNKING", "250-BINARYMIME"} {
+		found := false
+		for _, line := range ehlo {
+			if line == ext {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s in EHLO response, got %v", ext, ehlo)
+		}
+	}
+
+	// Binary content with bare LFs, a NUL byte and a leading dot must be
+	// stored exactly as sent.
+	chunk1 := "Subject: Binary\r\nContent-Type: application/octet-stream\r\n\r\n"
+	chunk2 := ".leading dot\nbare LF\x00NUL\r\n"
+
+	// Send the whole transaction in one write, as a pipelining client would
+	pipeline := "MAIL FROM:<sender@test.com> BODY=BINARYMIME\r\n" +
+		"RCPT TO:<recipient@test.com>\r\n" +
+		fmt.Sprintf("BDAT %d\r\n", len(chunk1)) + chunk1 +
+		fmt.Sprintf("BDAT %d LAST\r\n", len(chunk2)) + chunk2 +
+		"NOOP\r\n"
+	if _, err := conn.Write([]byte(pipeline)); err != nil {
+		t.Fatalf("failed to write pipeline: %v", err)
+	}
+
+	expected := []string{
+		"250 OK",
+		"250 OK",
+		fmt.Sprintf("250 %d octets received", len(chunk1)),
+		"250 OK: Message queued",
+		"250 OK",
+	}
+	for _, want := range expected {
+		if got := readLineReader(); got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if string(messages[0].RawData) != chunk1+chunk2 {
+		t.Errorf("expected raw data to be stored unchanged, got %q", messages[0].RawData)
+	}
+	if messages[0].Subject != "Binary" {
+		t.Errorf("expected subject 'Binary', got %q", messages[0].Subject)
+	}
+}
+
+func TestBdatErrors(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Server.MaxMessageSize = 10
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	// Without a transaction the chunk is still consumed
+	writeLine(t, conn, "BDAT 5 LAST")
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write chunk: %v", err)
+	}
+	if response := readLineReader(); !strings.HasPrefix(response, "503") {
+		t.Errorf("expected 503 without RCPT, got: %s", response)
+	}
+
+	writeLine(t, conn, "MAIL FROM:<sender@test.com> BODY=BINARYMIME")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+
+	writeLine(t, conn, "DATA")
+	if response := readLineReader(); !strings.HasPrefix(response, "503") {
+		t.Errorf("expected 503 for DATA with BODY=BINARYMIME, got: %s", response)
+	}
+
+	writeLine(t, conn, "BDAT 8")
+	if _, err := conn.Write([]byte("12345678")); err != nil {
+		t.Fatalf("failed to write chunk: %v", err)
+	}
+	readLineReader()
+	writeLine(t, conn, "BDAT 8 LAST")
+	if _, err := conn.Write([]byte("12345678")); err != nil {
+		t.Fatalf("failed to write chunk: %v", err)
+	}
+	if response := readLineReader(); !strings.HasPrefix(response, "552") {
+		t.Errorf("expected 552 once the limit is exceeded, got: %s", response)
+	}
+
+	writeLine(t, conn, "MAIL FROM:<sender@test.com> BODY=UNKNOWN")
+	if response := readLineReader(); !strings.HasPrefix(response, "501") {
+		t.Errorf("expected 501 for an unknown BODY value, got: %s", response)
+	}
+
+	writeLine(t, conn, "BDAT abc")
+	if response := readLineReader(); !strings.HasPrefix(response, "501") {
+		t.Errorf("expected 501 for an invalid size, got: %s", response)
+	}
+
+	// A size that overflows the running total is rejected, not allocated
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "BDAT 1")
+	if _, err := conn.Write([]byte("X")); err != nil {
+		t.Fatalf("failed to write chunk: %v", err)
+	}
+	readLineReader()
+	writeLine(t, conn, "BDAT 9223372036854775807 LAST")
+	conn.Close()
+
+	// The server is still up
+	conn = connectToServer(t, port)
+	defer conn.Close()
+	if greeting := readLine(t, conn); !strings.HasPrefix(greeting, "220") {
+		t.Errorf("expected the server to keep running, got: %s", greeting)
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	found := false
+	for _, line := range ehlo {
+		if line == "250-SMTPUTF8" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected SMTPUTF8 in EHLO response, got %v", ehlo)
+	}
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"MAIL FROM:<jürgen@bücher.example>", "553"},
+		{"MAIL FROM:<sender@test.com> SMTPUTF8=yes", "501"},
+		{"MAIL FROM:<sender@test.com>", "250"},
+		{"RCPT TO:<用户@例子.广告>", "553"},
+		{"MAIL FROM:<jürgen@bücher.example> SMTPUTF8", "250"},
+		{"RCPT TO:<用户@例子.广告>", "250"},
+		{"RCPT TO:<\xff@test.com>", "501"},
+	}
+	for _, tt := range tests {
+		writeLine(t, conn, tt.command)
+		if response := readLineReader(); !strings.HasPrefix(response, tt.expected) {
+			t.Errorf("%s: expected %s, got: %s", tt.command, tt.expected, response)
+		}
+	}
+
+	writeLine(t, conn, "DATA")
+	readLineReader()
+	writeLine(t, conn, "From: Jürgen <jürgen@bücher.example>")
+	writeLine(t, conn, "Subject: Grüße")
+	writeLine(t, conn, "")
+	writeLine(t, conn, "Hallo")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %s", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if !msg.SMTPUTF8 {
+		t.Error("expected the message to be flagged as SMTPUTF8")
+	}
+	if msg.Sender != "jürgen@bücher.example" || msg.Recipients != "用户@例子.广告" {
+		t.Errorf("unexpected envelope: %q -> %q", msg.Sender, msg.Recipients)
+	}
+	if msg.Subject != "Grüße" {
+		t.Errorf("expected UTF-8 subject, got %q", msg.Subject)
+	}
+}
+
+func TestDSNParameters(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	found := false
+	for _, line := range ehlo {
+		if line == "250-DSN" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected DSN in EHLO response, got %v", ehlo)
+	}
+
+	tests := []struct {
+		command  string
+		expected string
+	}{
+		{"MAIL FROM:<sender@test.com> RET=BODY", "501"},
+		{"MAIL FROM:<sender@test.com> ENVID=bad=id", "501"},
+		{"MAIL FROM:<sender@test.com> ENVID=" + strings.Repeat("x", 101), "501"},
+		{"MAIL FROM:<sender@test.com> RET=hdrs ENVID=QQ+2B314159", "250"},
+		{"RCPT TO:<a@test.com> NOTIFY=NEVER,FAILURE", "501"},
+		{"RCPT TO:<a@test.com> NOTIFY=SOMETIMES", "501"},
+		{"RCPT TO:<a@test.com> ORCPT=a@test.com", "501"},
+		{"RCPT TO:<a@test.com> NOTIFY=success,failure ORCPT=rfc822;a+2Bx@test.com", "250"},
+		{"RCPT TO:<b@test.com>", "250"},
+	}
+	for _, tt := range tests {
+		writeLine(t, conn, tt.command)
+		if response := readLineReader(); !strings.HasPrefix(response, tt.expected) {
+			t.Errorf("%s: expected %s, got: %s", tt.command, tt.expected, response)
+		}
+	}
+
+	writeLine(t, conn, "DATA")
+	readLineReader()
+	writeLine(t, conn, "Subject: DSN")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %s", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.DSNRet != "HDRS" || msg.DSNEnvID != "QQ+314159" {
+		t.Errorf("unexpected DSN parameters: ret %q envid %q", msg.DSNRet, msg.DSNEnvID)
+	}
+
+	recipients, err := db.GetRecipients(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get recipients: %v", err)
+	}
+	if len(recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(recipients))
+	}
+	if recipients[0].Notify != "SUCCESS,FAILURE" || recipients[0].ORCPT != "rfc822;a+x@test.com" {
+		t.Errorf("unexpected first recipient: %+v", recipients[0])
+	}
+	if recipients[1].Address != "b@test.com" || recipients[1].Notify != "" || recipients[1].ORCPT != "" {
+		t.Errorf("unexpected second recipient: %+v", recipients[1])
+	}
+}
+
+func TestDSNFailureReport(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.DSN.FailRecipients = []string{"*@bounce.test"}
+	})
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	send := func(commands ...string) {
+		for _, command := range commands {
+			writeLine(t, conn, command)
+			if response := readLineReader(); !strings.HasPrefix(response, "250") {
+				t.Fatalf("%s: expected 250, got: %s", command, response)
+			}
+		}
+		writeLine(t, conn, "DATA")
+		readLineReader()
+		writeLine(t, conn, "Subject: Hello")
+		writeLine(t, conn, "")
+		writeLine(t, conn, "secret body")
+		writeLine(t, conn, ".")
+		if response := readLineReader(); !strings.HasPrefix(response, "250") {
+			t.Fatalf("expected 250 after DATA, got: %s", response)
+		}
+	}
+
+	// NOTIFY=NEVER suppresses the report
+	send("MAIL FROM:<sender@test.com>", "RCPT TO:<user@bounce.test> NOTIFY=NEVER")
+	// The null sender never gets a report
+	send("MAIL FROM:<>", "RCPT TO:<user@bounce.test>")
+	send("MAIL FROM:<sender@test.com> ENVID=env-42",
+		"RCPT TO:<ok@test.com>",
+		"RCPT TO:<User@Bounce.test> ORCPT=rfc822;orig@test.com")
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("expected 3 messages and 1 report, got %d", len(messages))
+	}
+
+	var report *database.Message
+	for i := range messages {
+		if messages[i].Sender == "" && messages[i].Recipients == "sender@test.com" {
+			report = &messages[i]
+		}
+	}
+	if report == nil {
+		t.Fatal("expected a DSN addressed to the sender")
+	}
+
+	raw := string(report.RawData)
+	for _, want := range []string{
+		"Content-Type: multipart/report; report-type=delivery-status",
+		"Original-Envelope-Id: env-42",
+		"Original-Recipient: rfc822;orig@test.com",
+		"Final-Recipient: rfc822; User@Bounce.test",
+		"Action: failed",
+		"Status: 5.1.1",
+		"Content-Type: text/rfc822-headers",
+		"Subject: Hello",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("expected %q in DSN:\n%s", want, raw)
+		}
+	}
+	if strings.Contains(raw, "ok@test.com") {
+		t.Error("expected only failing recipients in the DSN")
+	}
+	if strings.Contains(raw, "secret body") {
+		t.Error("expected only headers to be returned without RET=FULL")
+	}
+	if report.Subject != "Delivery Status Notification (Failure)" {
+		t.Errorf("unexpected DSN subject %q", report.Subject)
+	}
+}
+
+func TestEnvelopeStoredSeparately(t *testing.T) {
+	_, db, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	for _, command := range []string{
+		"MAIL FROM:<sender@test.com>  BODY=8BITMIME SIZE=100",
+		"RCPT TO:<to@test.com>",
+		"RCPT TO:<hidden@test.com>",
+		"DATA",
+	} {
+		writeLine(t, conn, command)
+		readLineReader()
+	}
+	writeLine(t, conn, "To: To <to@test.com>")
+	writeLine(t, conn, "Cc: cc1@test.com, \"Cc, Two\" <cc2@test.com>")
+	writeLine(t, conn, "Subject: Bcc")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %s", response)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	msg := messages[0]
+	if msg.Helo != "localhost" || msg.MailParams != "BODY=8BITMIME SIZE=100" || msg.TLS || msg.Authenticated {
+		t.Errorf("unexpected transaction details: helo %q params %q tls %v auth %v", msg.Helo, msg.MailParams, msg.TLS, msg.Authenticated)
+	}
+
+	recipients, err := db.GetRecipients(msg.ID)
+	if err != nil {
+		t.Fatalf("failed to get recipients: %v", err)
+	}
+	var got []string
+	for _, rcpt := range recipients {
+		got = append(got, rcpt.Type+":"+rcpt.Address)
+	}
+	expected := "rcpt:to@test.com rcpt:hidden@test.com to:to@test.com cc:cc1@test.com cc:cc2@test.com"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected recipients %q, got %q", expected, strings.Join(got, " "))
+	}
+
+	// The Bcc recipient is only reachable through the envelope
+	results, _, err := db.ListMessages(database.ListOptions{Recipient: "hidden@test.com"})
+	if err != nil {
+		t.Fatalf("failed to list messages: %v", err)
+	}
+	if len(results) != 1 {
+		t.Errorf("expected the message to be found by its Bcc recipient, got %d", len(results))
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		wantErr  bool
+	}{
+		{"plain", "plain", false},
+		{"a+2Bb+3Dc", "a+b=c", false},
+		{"bad=char", "", true},
+		{"lower+2b", "", true},
+		{"short+2", "", true},
+		{"space here", "", true},
+	}
+	for _, tt := range tests {
+		got, err := decodeXtext(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeXtext(%q): unexpected error %v", tt.input, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("decodeXtext(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestNOOP(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	readLine(t, conn) // greeting
+
+	writeLine(t, conn, "NOOP")
+	response := readLine(t, conn)
+
+	if !strings.HasPrefix(response, "250") {
+		t.Errorf("expected 250 response, got: %s", response)
+	}
+}
+
+func TestRSET(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	readLine(t, conn) // greeting
+	writeLine(t, conn, "HELO localhost")
+	readLine(t, conn)
+	writeLine(t, conn, "MAIL FROM:<sender@example.com>")
+	readLine(t, conn)
+
+	writeLine(t, conn, "RSET")
+	response := readLine(t, conn)
+
+	if !strings.HasPrefix(response, "250") {
+		t.Errorf("expected 250 response, got: %s", response)
+	}
+
+	// After RSET, RCPT should fail (no MAIL FROM)
+	writeLine(t, conn, "RCPT TO:<recipient@example.com>")
+	response = readLine(t, conn)
+
+	if !strings.HasPrefix(response, "503") {
+		t.Errorf("expected 503 response after RSET, got: %s", response)
+	}
+}
+
+func TestQUIT(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	readLine(t, conn) // greeting
+
+	writeLine(t, conn, "QUIT")
+	response := readLine(t, conn)
+
+	if !strings.HasPrefix(response, "221") {
+		t.Errorf("expected 221 response, got: %s", response)
+	}
+}
+
+func TestVRFY(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	readLine(t, conn) // greeting
+
+	writeLine(t, conn, "VRFY user@example.com")
+	response := readLine(t, conn)
+
+	if !strings.HasPrefix(response, "252") {
+		t.Errorf("expected 252 response, got: %s", response)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	readLine(t, conn) // greeting
+
+	writeLine(t, conn, "INVALID")
+	response := readLine(t, conn)
+
+	if !strings.HasPrefix(response, "502") {
+		t.Errorf("expected 502 response, got: %s", response)
+	}
+}
+
+func TestShutdownIdleSession(t *testing.T) {
+	server, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	readLineReader() // greeting
+	writeLine(t, conn, "NOOP")
+	readLineReader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	response := readLineReader()
+	if !strings.HasPrefix(response, "421") {
+		t.Errorf("expected 421 response on shutdown, got: %s", response)
+	}
+
+	if _, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 200*time.Millisecond); err == nil {
+		t.Error("expected listener to be closed after shutdown")
+	}
+}
+
+func TestShutdownWaitsForData(t *testing.T) {
+	server, db, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	readLineReader() // greeting
+	writeLine(t, conn, "HELO localhost")
+	readLineReader()
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
+	writeLine(t, conn, "Subject: In flight")
+	writeLine(t, conn, "")
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownErr <- server.Shutdown(ctx)
+	}()
+
+	// Give Shutdown a moment to start before finishing the transfer
+	time.Sleep(50 * time.Millisecond)
+	writeLine(t, conn, "Still being delivered.")
+	writeLine(t, conn, ".")
+
+	response := readLineReader()
+	if !strings.HasPrefix(response, "250") {
+		t.Errorf("expected 250 response after DATA, got: %s", response)
+	}
+
+	response = readLineReader()
+	if !strings.HasPrefix(response, "421") {
+		t.Errorf("expected 421 response after DATA, got: %s", response)
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("expected clean shutdown, got: %v", err)
+	}
+
+	messages, err := db.GetMessages()
+	if err != nil {
+		t.Fatalf("failed to get messages: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Errorf("expected 1 message, got %d", len(messages))
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	server, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn := connectToServer(t, port)
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readLineReader := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, _ := reader.ReadString('\n')
+		return strings.TrimSpace(line)
+	}
+
+	readLineReader() // greeting
+	writeLine(t, conn, "HELO localhost")
+	readLineReader()
+	writeLine(t, conn, "MAIL FROM:<sender@test.com>")
+	readLineReader()
+	writeLine(t, conn, "RCPT TO:<recipient@test.com>")
+	readLineReader()
+	writeLine(t, conn, "DATA")
+	readLineReader()
+
+	// Never finish the transfer
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("expected connection to be closed")
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	server, _, _, _, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	if err := server.Serve(listener); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed, got: %v", err)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	logger := NewLogger(10)
+
+	logger.Info("test message %d", 1)
+	logger.Warn("warning message")
+	logger.Error("error message")
+	logger.Debug("debug message")
+
+	// Read from channel
+	entries := make([]LogEntry, 0)
+	timeout := time.After(100 * time.Millisecond)
+
+loop:
+	for {
+		select {
+		case entry := <-logger.Channel():
+			entries = append(entries, entry)
+		case <-timeout:
+			break loop
+		}
+	}
+
+	if len(entries) != 4 {
+		t.Errorf("expected 4 log entries, got %d", len(entries))
+	}
+}
+
+func TestLogEntryString(t *testing.T) {
+	entry := LogEntry{
+		Time:    time.Date(2025, 1, 15, 10, 30, 45, 0, time.UTC),
+		Level:   LogInfo,
+		Message: "test message",
+	}
+
+	str := entry.String()
+	if !strings.Contains(str, "10:30:45") {
+		t.Errorf("expected time in string, got: %s", str)
+	}
+	if !strings.Contains(str, "INFO") {
+		t.Errorf("expected INFO in string, got: %s", str)
+	}
+	if !strings.Contains(str, "test message") {
+		t.Errorf("expected message in string, got: %s", str)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		level    LogLevel
+		expected string
+	}{
+		{LogInfo, "INFO"},
+		{LogWarning, "WARN"},
+		{LogError, "ERROR"},
+		{LogDebug, "DEBUG"},
+	}
+
+	for _, tt := range tests {
 		if tt.level.String() != tt.expected {
 			t.Errorf("expected %q, got %q", tt.expected, tt.level.String())
 		}
 	}
 }
+
+func TestLogEntryFormat(t *testing.T) {
+	entry := LogEntry{
+		Time:    time.Date(2025, 1, 15, 10, 30, 45, 0, time.UTC),
+		Level:   LogWarning,
+		Message: "test message",
+	}
+
+	plain, err := entry.Format(LogFormatPlain)
+	if err != nil {
+		t.Fatalf("failed to format plain entry: %v", err)
+	}
+	if plain != "2025-01-15T10:30:45Z WARN  test message" {
+		t.Errorf("unexpected plain format: %q", plain)
+	}
+
+	jsonLine, err := entry.Format(LogFormatJSON)
+	if err != nil {
+		t.Fatalf("failed to format json entry: %v", err)
+	}
+	expected := `{"time":"2025-01-15T10:30:45Z","level":"WARN","message":"test message"}`
+	if jsonLine != expected {
+		t.Errorf("expected %s, got %s", expected, jsonLine)
+	}
+
+	if _, err := entry.Format("xml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestLoggerDrain(t *testing.T) {
+	logger := NewLogger(10)
+	logger.Info("hello")
+	logger.Error("boom")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var out, errOut strings.Builder
+	if err := logger.Drain(ctx, &out, &errOut, LogFormatPlain); err != nil {
+		t.Fatalf("drain failed: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "INFO  hello") {
+		t.Errorf("expected info entry on stdout, got %q", out.String())
+	}
+	if !strings.Contains(errOut.String(), "ERROR boom") {
+		t.Errorf("expected error entry on stderr, got %q", errOut.String())
+	}
+}
@@ -0,0 +1,150 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/lawnchairsociety/devsmtp/internal/database"
+)
+
+// Attributes accepted by the Postfix XCLIENT and XFORWARD extensions, in the
+// order they are advertised.
+var (
+	xclientAttributes  = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR", "DESTPORT"}
+	xforwardAttributes = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+)
+
+// xattr is an XCLIENT or XFORWARD attribute value. Unavailable is set for
+// [UNAVAILABLE] and [TEMPUNAVAIL], which leave value empty.
+type xattr struct {
+	value       string
+	unavailable bool
+}
+
+// parseXAttributes parses "NAME=value ..." arguments, allowing only the
+// attribute names in allowed. Values are xtext-encoded.
+func parseXAttributes(args string, allowed []string) (map[string]xattr, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("expected %s=value", strings.Join(allowed, "|"))
+	}
+
+	attrs := make(map[string]xattr, len(fields))
+	for _, field := range fields {
+		name, value, ok := strings.Cut(field, "=")
+		name = strings.ToUpper(name)
+		if !ok || !slices.Contains(allowed, name) {
+			return nil, fmt.Errorf("bad attribute name: %s", name)
+		}
+
+		value, err := decodeXtext(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value: %v", name, err)
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			attrs[name] = xattr{unavailable: true}
+			continue
+		}
+
+		if name == "ADDR" {
+			// IPv6 addresses are sent as "IPV6:2001:db8::1"
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ADDR value: %s", value)
+			}
+			value = ip.String()
+		}
+		attrs[name] = xattr{value: value}
+	}
+	return attrs, nil
+}
+
+// checkXClientPeer answers cmd with an error and returns false unless the
+// peer is trusted and no mail transaction is in progress.
+func (sess *session) checkXClientPeer(cmd string) bool {
+	if !sess.xclientAllowed {
+		sess.server.logger.Warn("[%s] %s rejected: peer not in xclient.trusted", sess.clientIP, cmd)
+		sess.writeLine("550 5.7.0 Error: insufficient authorization")
+		return false
+	}
+	if sess.inTransaction {
+		sess.writeLine("503 5.5.1 Error: MAIL transaction in progress")
+		return false
+	}
+	return true
+}
+
+// handleXClient replaces the client details for the rest of the session and
+// starts over with a new greeting, as Postfix does.
+func (sess *session) handleXClient(args string) {
+	if !sess.checkXClientPeer("XCLIENT") {
+		return
+	}
+	attrs, err := parseXAttributes(args, xclientAttributes)
+	if err != nil {
+		sess.writeLine("501 5.5.4 Syntax error in XCLIENT parameters: " + err.Error())
+		return
+	}
+
+	peer := sess.clientIP
+	// The original address is kept when the new one is unknown, so limits
+	// and logs still have something to go on.
+	if addr, ok := attrs["ADDR"]; ok && !addr.unavailable {
+		sess.clientIP = addr.value
+	}
+	if name, ok := attrs["NAME"]; ok {
+		sess.clientName = name.value
+	}
+	if helo, ok := attrs["HELO"]; ok {
+		sess.helo = helo.value
+		sess.xclientHelo = true
+	}
+	if login, ok := attrs["LOGIN"]; ok {
+		sess.authUser = login.value
+		sess.authenticated = login.value != ""
+	}
+
+	sess.server.logger.Info("[%s] XCLIENT from %s: %s", sess.clientIP, peer, args)
+	sess.resetTransaction()
+	sess.writeLine("220 DevSmtp ESMTP Service Ready")
+}
+
+// handleXForward records client details for the next message only.
+func (sess *session) handleXForward(args string) {
+	if !sess.checkXClientPeer("XFORWARD") {
+		return
+	}
+	attrs, err := parseXAttributes(args, xforwardAttributes)
+	if err != nil {
+		sess.writeLine("501 5.5.4 Syntax error in XFORWARD parameters: " + err.Error())
+		return
+	}
+
+	if sess.xforward == nil {
+		sess.xforward = make(map[string]xattr)
+	}
+	for name, attr := range attrs {
+		sess.xforward[name] = attr
+	}
+	sess.server.logger.Debug("[%s] XFORWARD %s", sess.clientIP, args)
+	sess.writeLine("250 2.0.0 Ok")
+}
+
+// applyXForward replaces the client details stored with msg by those sent
+// with XFORWARD, if any.
+func (sess *session) applyXForward(msg *database.Message) {
+	if addr, ok := sess.xforward["ADDR"]; ok && !addr.unavailable {
+		msg.ClientIP = addr.value
+	}
+	if name, ok := sess.xforward["NAME"]; ok {
+		msg.ClientName = name.value
+	}
+	if helo, ok := sess.xforward["HELO"]; ok {
+		msg.Helo = helo.value
+	}
+}
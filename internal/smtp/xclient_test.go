@@ -0,0 +1,148 @@
+package smtp
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lawnchairsociety/devsmtp/internal/config"
+)
+
+func setupXClientServer(t *testing.T) (*Server, int, func()) {
+	t.Helper()
+	server, _, _, port, cleanup := setupTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.XClient.Trusted = []string{"127.0.0.0/8"}
+	})
+	return server, port, cleanup
+}
+
+func TestXClient(t *testing.T) {
+	server, port, cleanup := setupXClientServer(t)
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	if !slices.Contains(ehlo, "250-XCLIENT NAME ADDR PORT PROTO HELO LOGIN DESTADDR DESTPORT") {
+		t.Errorf("expected XCLIENT to be advertised, got: %v", ehlo)
+	}
+
+	writeLine(t, conn, "XCLIENT ADDR=IPV6:2001:db8::5 NAME=mail.example.com HELO=relay+2Eexample.com LOGIN=alice")
+	if response := readLineReader(); !strings.HasPrefix(response, "220") {
+		t.Fatalf("expected a new 220 greeting, got: %q", response)
+	}
+	writeLine(t, conn, "EHLO localhost")
+	for response := readLineReader(); !strings.HasPrefix(response, "250 "); response = readLineReader() {
+		if !strings.HasPrefix(response, "250-") {
+			t.Fatalf("unexpected EHLO response: %q", response)
+		}
+	}
+
+	for _, command := range []string{"MAIL FROM:<sender@test.com>", "RCPT TO:<recipient@test.com>", "DATA"} {
+		writeLine(t, conn, command)
+		readLineReader()
+	}
+	writeLine(t, conn, "Subject: XCLIENT")
+	writeLine(t, conn, "")
+	writeLine(t, conn, ".")
+	if response := readLineReader(); !strings.HasPrefix(response, "250") {
+		t.Fatalf("expected 250 after DATA, got: %q", response)
+	}
+
+	messages, err := server.db.GetMessages()
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d (%v)", len(messages), err)
+	}
+	msg := messages[0]
+	if msg.ClientIP != "2001:db8::5" || msg.ClientName != "mail.example.com" || msg.Helo != "relay.example.com" {
+		t.Errorf("unexpected client details: ip %q name %q helo %q", msg.ClientIP, msg.ClientName, msg.Helo)
+	}
+	if msg.AuthUser != "alice" || !msg.Authenticated {
+		t.Errorf("expected the message to be stored as authenticated by alice, got %q %v", msg.AuthUser, msg.Authenticated)
+	}
+}
+
+func TestXForward(t *testing.T) {
+	server, port, cleanup := setupXClientServer(t)
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	send := func(commands ...string) {
+		t.Helper()
+		for _, command := range commands {
+			writeLine(t, conn, command)
+			if response := readLineReader(); !strings.HasPrefix(response, "2") && !strings.HasPrefix(response, "3") {
+				t.Fatalf("%s: unexpected response %q", command, response)
+			}
+		}
+		writeLine(t, conn, "Subject: XFORWARD")
+		writeLine(t, conn, "")
+		writeLine(t, conn, ".")
+		if response := readLineReader(); !strings.HasPrefix(response, "250") {
+			t.Fatalf("expected 250 after DATA, got: %q", response)
+		}
+	}
+
+	// The attributes apply to the next message only
+	send("XFORWARD ADDR=192.0.2.9 NAME=[UNAVAILABLE]", "XFORWARD HELO=client.example.com",
+		"MAIL FROM:<sender@test.com>", "RCPT TO:<recipient@test.com>", "DATA")
+	send("MAIL FROM:<sender@test.com>", "RCPT TO:<recipient@test.com>", "DATA")
+
+	messages, err := server.db.GetMessages()
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d (%v)", len(messages), err)
+	}
+	got := []string{messages[0].ClientIP + " " + messages[0].Helo, messages[1].ClientIP + " " + messages[1].Helo}
+	slices.Sort(got)
+	if expected := []string{"127.0.0.1 localhost", "192.0.2.9 client.example.com"}; !slices.Equal(got, expected) {
+		t.Errorf("expected client details %q, got %q", expected, got)
+	}
+}
+
+func TestXClientErrors(t *testing.T) {
+	_, port, cleanup := setupXClientServer(t)
+	defer cleanup()
+
+	conn, readLineReader, _ := startAuthSession(t, port)
+	defer conn.Close()
+
+	for _, tc := range []struct {
+		command string
+		code    string
+	}{
+		{"XCLIENT", "501"},
+		{"XCLIENT FOO=bar", "501"},
+		{"XCLIENT ADDR=not-an-ip", "501"},
+		{"XFORWARD LOGIN=alice", "501"},
+		{"MAIL FROM:<sender@test.com>", "250"},
+		{"XCLIENT ADDR=192.0.2.1", "503"},
+		{"XFORWARD ADDR=192.0.2.1", "503"},
+	} {
+		writeLine(t, conn, tc.command)
+		if response := readLineReader(); !strings.HasPrefix(response, tc.code) {
+			t.Errorf("%s: expected %s, got: %q", tc.command, tc.code, response)
+		}
+	}
+}
+
+func TestXClientUntrustedPeer(t *testing.T) {
+	_, _, _, port, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	conn, readLineReader, ehlo := startAuthSession(t, port)
+	defer conn.Close()
+
+	for _, line := range ehlo {
+		if strings.Contains(line, "XCLIENT") || strings.Contains(line, "XFORWARD") {
+			t.Errorf("expected XCLIENT and XFORWARD not to be advertised, got: %q", line)
+		}
+	}
+	for _, command := range []string{"XCLIENT ADDR=192.0.2.1", "XFORWARD ADDR=192.0.2.1"} {
+		writeLine(t, conn, command)
+		if response := readLineReader(); !strings.HasPrefix(response, "550 5.7.0") {
+			t.Errorf("%s: expected 550, got: %q", command, response)
+		}
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/lawnchairsociety/devsmtp/internal/attachment"
 	"github.com/lawnchairsociety/devsmtp/internal/config"
 	"github.com/lawnchairsociety/devsmtp/internal/database"
+	"github.com/lawnchairsociety/devsmtp/internal/relay"
 	"github.com/lawnchairsociety/devsmtp/internal/smtp"
 )
 
@@ -136,11 +138,27 @@ type model struct {
 	width          int
 	height         int
 	ready          bool
+
+	// Only show messages sent by this authenticated user; empty shows all
+	userFilter string
+
+	// Attachments of the selected message
+	attachments     []database.Part
+	attachmentMsgID int64
+	attachmentIdx   int
 }
 
 type logMsg smtp.LogEntry
 type refreshMsg struct{}
 
+// releaseMsg reports the result of releasing a message upstream.
+type releaseMsg struct {
+	id    int64
+	to    []string
+	relay string
+	err   error
+}
+
 func Run(db *database.DB, cfg *config.Config, logChan <-chan smtp.LogEntry) error {
 	m := initialModel(db, cfg, logChan)
 	p := tea.NewProgram(m, tea.WithAltScreen())
@@ -299,7 +317,7 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if len(m.messages) > 0 {
 				msg := m.messages[m.selectedIdx]
 				_ = m.db.DeleteMessage(msg.ID)
-				m.messages, _ = m.db.GetMessages()
+				m.loadMessages()
 				if m.selectedIdx >= len(m.messages) && m.selectedIdx > 0 {
 					m.selectedIdx--
 				}
@@ -308,14 +326,50 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 
 		case "D":
-			_ = m.db.DeleteAllMessages()
+			if m.userFilter != "" {
+				_ = m.db.DeleteUserMessages(m.userFilter)
+			} else {
+				_ = m.db.DeleteAllMessages()
+			}
 			m.messages = []database.Message{}
 			m.selectedIdx = 0
 			m.updateDetailContent()
 			return m, nil
 
+		case "a":
+			if len(m.attachments) > 0 {
+				m.attachmentIdx = (m.attachmentIdx + 1) % len(m.attachments)
+				m.updateDetailContent()
+			}
+			return m, nil
+
+		case "s":
+			if len(m.attachments) > 0 {
+				part := m.attachments[m.attachmentIdx]
+				path, err := attachment.Save(m.cfg.Attachments.Dir, part)
+				if err != nil {
+					m.addLog(smtp.LogError, fmt.Sprintf("Failed to save attachment %s: %v", attachment.Name(part), err))
+				} else {
+					m.addLog(smtp.LogInfo, fmt.Sprintf("Saved attachment to %s", path))
+				}
+			}
+			return m, nil
+
+		case "R":
+			if len(m.messages) > 0 {
+				cmds = append(cmds, m.release(m.messages[m.selectedIdx].ID))
+			}
+			return m, tea.Batch(cmds...)
+
+		case "u":
+			m.cycleUserFilter()
+			m.selectedIdx = 0
+			m.loadMessages()
+			m.updateDetailContent()
+			return m, nil
+
 		case "r":
-			m.messages, _ = m.db.GetMessages()
+			m.loadMessages()
 			if m.selectedIdx >= len(m.messages) && m.selectedIdx > 0 {
 				m.selectedIdx = len(m.messages) - 1
 			}
@@ -324,17 +378,19 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 	case logMsg:
-		m.logs = append(m.logs, smtp.LogEntry(msg))
-		if len(m.logs) > 500 {
-			m.logs = m.logs[len(m.logs)-500:]
-		}
-		m.updateLogContent()
-		m.logViewport.GotoBottom()
+		m.appendLog(smtp.LogEntry(msg))
 		cmds = append(cmds, m.waitForLog())
 
+	case releaseMsg:
+		if msg.err != nil {
+			m.addLog(smtp.LogError, fmt.Sprintf("Failed to release message %d: %v", msg.id, msg.err))
+		} else {
+			m.addLog(smtp.LogInfo, fmt.Sprintf("Message %d released to %s via %s", msg.id, strings.Join(msg.to, ", "), msg.relay))
+		}
+
 	case refreshMsg:
 		oldCount := len(m.messages)
-		m.messages, _ = m.db.GetMessages()
+		m.loadMessages()
 		if len(m.messages) > oldCount {
 			m.updateDetailContent()
 		}
@@ -344,23 +400,122 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	return m, tea.Batch(cmds...)
 }
 
+// release sends a message to relay.release_to in the background, so the UI
+// is not blocked on the upstream server.
+func (m model) release(id int64) tea.Cmd {
+	return func() tea.Msg {
+		rl, err := relay.New(m.cfg.Relay)
+		if err != nil {
+			return releaseMsg{id: id, err: err}
+		}
+		msg, err := m.db.GetMessage(id)
+		if err != nil {
+			return releaseMsg{id: id, err: err}
+		}
+		to, err := rl.Release(msg, nil)
+		return releaseMsg{id: id, to: to, relay: rl.Addr(), err: err}
+	}
+}
+
+func (m *model) loadMessages() {
+	if m.userFilter == "" {
+		m.messages, _ = m.db.GetMessages()
+		return
+	}
+	m.messages, _, _ = m.db.ListMessages(database.ListOptions{User: m.userFilter})
+}
+
+// cycleUserFilter switches to the next user that has sent mail, going back
+// to all messages after the last one.
+func (m *model) cycleUserFilter() {
+	users, _ := m.db.GetAuthUsers()
+
+	next := ""
+	for i, user := range users {
+		if m.userFilter == "" {
+			next = user
+			break
+		}
+		if user == m.userFilter && i+1 < len(users) {
+			next = users[i+1]
+			break
+		}
+	}
+	m.userFilter = next
+}
+
+func (m *model) appendLog(entry smtp.LogEntry) {
+	m.logs = append(m.logs, entry)
+	if len(m.logs) > 500 {
+		m.logs = m.logs[len(m.logs)-500:]
+	}
+	m.updateLogContent()
+	m.logViewport.GotoBottom()
+}
+
+// addLog shows a TUI action result in the log panel.
+func (m *model) addLog(level smtp.LogLevel, message string) {
+	m.appendLog(smtp.LogEntry{
+		Time:    time.Now(),
+		Level:   level,
+		Message: message,
+	})
+}
+
+func (m *model) loadAttachments(msg database.Message) {
+	if msg.ID == m.attachmentMsgID && m.attachments != nil {
+		return
+	}
+
+	attachments, _ := m.db.GetAttachments(msg.ID)
+	if attachments == nil {
+		attachments = []database.Part{}
+	}
+	m.attachments = attachments
+	m.attachmentMsgID = msg.ID
+	m.attachmentIdx = 0
+}
+
 func (m *model) updateDetailContent() {
 	if len(m.messages) == 0 {
+		m.attachments = nil
+		m.attachmentMsgID = 0
 		m.detailViewport.SetContent("No messages")
 		return
 	}
 
 	msg := m.messages[m.selectedIdx]
+	m.loadAttachments(msg)
 	var sb strings.Builder
 
+	from := msg.From
+	if from == "" {
+		from = msg.Sender
+	}
 	sb.WriteString(headerKeyStyle.Render("From:    "))
-	sb.WriteString(headerValStyle.Render(msg.Sender))
+	sb.WriteString(headerValStyle.Render(from))
 	sb.WriteString("\n")
 
+	to := msg.To
+	if to == "" {
+		to = msg.Recipients
+	}
 	sb.WriteString(headerKeyStyle.Render("To:      "))
-	sb.WriteString(headerValStyle.Render(msg.Recipients))
+	sb.WriteString(headerValStyle.Render(to))
 	sb.WriteString("\n")
 
+	if msg.Cc != "" {
+		sb.WriteString(headerKeyStyle.Render("Cc:      "))
+		sb.WriteString(headerValStyle.Render(msg.Cc))
+		sb.WriteString("\n")
+	}
+
+	if msg.ReplyTo != "" {
+		sb.WriteString(headerKeyStyle.Render("Reply-To:"))
+		sb.WriteString(headerValStyle.Render(" " + msg.ReplyTo))
+		sb.WriteString("\n")
+	}
+
 	sb.WriteString(headerKeyStyle.Render("Subject: "))
 	sb.WriteString(headerValStyle.Render(msg.Subject))
 	sb.WriteString("\n")
@@ -374,13 +529,45 @@ func (m *model) updateDetailContent() {
 	sb.WriteString("\n")
 
 	sb.WriteString(headerKeyStyle.Render("Client:  "))
-	sb.WriteString(headerValStyle.Render(msg.ClientIP))
+	client := msg.ClientIP
+	if msg.ClientName != "" {
+		client = fmt.Sprintf("%s (%s)", msg.ClientName, msg.ClientIP)
+	}
+	sb.WriteString(headerValStyle.Render(client))
 	sb.WriteString("\n")
 
+	if msg.AuthUser != "" {
+		sb.WriteString(headerKeyStyle.Render("User:    "))
+		sb.WriteString(headerValStyle.Render(msg.AuthUser))
+		sb.WriteString("\n")
+	}
+
 	sb.WriteString("\n")
 	sb.WriteString(lipgloss.NewStyle().Bold(true).Foreground(primaryColor).Render("─── Body ───"))
 	sb.WriteString("\n\n")
-	sb.WriteString(msg.Body)
+	if msg.Body == "" && msg.HTMLBody != "" {
+		sb.WriteString(msg.HTMLBody)
+	} else {
+		sb.WriteString(msg.Body)
+	}
+
+	if len(m.attachments) > 0 {
+		sb.WriteString("\n\n")
+		sb.WriteString(lipgloss.NewStyle().Bold(true).Foreground(primaryColor).Render("─── Attachments ───"))
+		sb.WriteString("\n\n")
+		for i, part := range m.attachments {
+			marker := "  "
+			if i == m.attachmentIdx {
+				marker = "> "
+			}
+			line := fmt.Sprintf("%s%d. %s  %s  %s", marker, i+1, attachment.Name(part), part.ContentType, attachment.FormatSize(part.Size))
+			if i == m.attachmentIdx {
+				line = selectedStyle.Render(line)
+			}
+			sb.WriteString(line)
+			sb.WriteString("\n")
+		}
+	}
 
 	sb.WriteString("\n\n")
 	sb.WriteString(lipgloss.NewStyle().Bold(true).Foreground(primaryColor).Render("─── Raw Headers ───"))
@@ -469,7 +656,7 @@ func (m model) View() string {
 			Render(logoContent)
 
 		// Build message list panel
-		listPanel := m.buildPanel("Messages", m.renderMessageList(listContentWidth, listContentHeight), leftWidth, msgPanelHeight, m.activePanel == messageListPanel)
+		listPanel := m.buildPanel(m.messageListTitle(), m.renderMessageList(listContentWidth, listContentHeight), leftWidth, msgPanelHeight, m.activePanel == messageListPanel)
 
 		// Left column: logo + messages
 		leftCol = lipgloss.JoinVertical(lipgloss.Left, logoBox, listPanel)
@@ -486,23 +673,34 @@ func (m model) View() string {
 			listContentHeight = 1
 		}
 
-		leftCol = m.buildPanel("Messages", m.renderMessageList(listContentWidth, listContentHeight), leftWidth, msgPanelHeight, m.activePanel == messageListPanel)
+		leftCol = m.buildPanel(m.messageListTitle(), m.renderMessageList(listContentWidth, listContentHeight), leftWidth, msgPanelHeight, m.activePanel == messageListPanel)
 	}
 
 	// Build detail panel (full main height)
 	detailPanel := m.buildPanel("Details", m.detailViewport.View(), rightWidth, mainHeight, m.activePanel == messageDetailPanel)
 
 	// Build log panel
-	logTitle := fmt.Sprintf("SMTP Logs - %s:%d", m.cfg.Server.Host, m.cfg.Server.Port)
+	var addrs []string
+	for _, l := range m.cfg.Server.ListenerConfigs() {
+		addrs = append(addrs, l.Addr())
+	}
+	logTitle := "SMTP Logs - " + strings.Join(addrs, ", ")
 	logPanel := m.buildPanel(logTitle, m.logViewport.View(), m.width, logPanelHeight, m.activePanel == logPanel)
 
 	// Combine
 	topRow := lipgloss.JoinHorizontal(lipgloss.Top, leftCol, detailPanel)
-	help := helpStyle.Render("↑↓/jk: navigate • tab: switch panel • enter: view • d: delete • D: delete all • r: refresh • q: quit")
+	help := helpStyle.Render("↑↓/jk: navigate • tab: switch panel • enter: view • u: filter user • a: next attachment • s: save attachment • R: release • d: delete • D: delete all • r: refresh • q: quit")
 
 	return lipgloss.JoinVertical(lipgloss.Left, topRow, logPanel, help)
 }
 
+func (m model) messageListTitle() string {
+	if m.userFilter == "" {
+		return "Messages"
+	}
+	return "Messages - " + m.userFilter
+}
+
 func (m model) buildPanel(title, content string, width, height int, active bool) string {
 	borderStyle := panelStyle
 	if active {
@@ -568,8 +766,8 @@ func (m model) renderMessageList(width, height int) string {
 		if subject == "" {
 			subject = "(no subject)"
 		}
-		if len(subject) > width-10 {
-			subject = subject[:width-13] + "..."
+		if runes := []rune(subject); len(runes) > width-10 {
+			subject = string(runes[:width-13]) + "..."
 		}
 
 		timeStr := msg.CreatedAt.Format("15:04")